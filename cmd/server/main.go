@@ -1,11 +1,17 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"io/fs"
+	"log"
 	"os"
 	"time"
 
+	"github.com/phrozen/password-hash-exercise/internal/app"
 	"github.com/phrozen/password-hash-exercise/internal/service"
+	"github.com/phrozen/password-hash-exercise/internal/store"
 )
 
 func main() {
@@ -15,9 +21,136 @@ func main() {
 	delay := flag.Duration("d", 5*time.Second, "Delay for writes")
 	port := flag.String("p", os.Getenv("PORT"), "Listening port")
 	logs := flag.Bool("l", true, "Enables logging")
+	backend := flag.String("store", "memory", "Store backend (memory|sharded|file|btree)")
+	data := flag.String("data", "data", "Data directory for the file and btree stores")
+	maxPending := flag.Int("max-pending", 0, "Maximum pending writes, past it POST /hash fails with 503 (0 is unlimited)")
+	pendingWait := flag.Duration("pending-wait", 0, "How long POST /hash waits for room once max pending is reached")
+	algorithm := flag.String("hash", "sha512", "Hash algorithm (sha512|pbkdf2-sha512|scrypt|argon2id|bcrypt)")
+	salt := flag.Int("salt", 16, fmt.Sprintf("Random salt length in bytes, at least %d (0 disables salting)", app.MIN_SALT_LENGTH))
+	pepperFile := flag.String("pepper", "", "Pepper key file, one <id>:<base64 key> per line, last is current")
+	snapshotPath := flag.String("snapshot-path", "", "Snapshot file for the memory store, restored on startup (empty disables snapshots)")
+	snapshotInterval := flag.Duration("snapshot-interval", 0, "How often the memory store is snapshotted, also done on shutdown (0 only on shutdown)")
+	walPath := flag.String("wal", "", "Write-ahead log file, pending writes are replayed from it on startup (empty disables it)")
+	walSync := flag.String("wal-sync", "always", "WAL sync policy (always|interval=<duration>|never)")
 	flag.Parse()
+	if err := checkSalt(*salt); err != nil {
+		usage(err)
+	}
+	// Select the Store backend, Hasher and Pepper, failing to set them up are
+	// the only errors that should stop execution before the server starts.
+	storeOptions := []store.Option{store.WithBackpressure(*maxPending, *pendingWait)}
+	if *walPath != "" {
+		policy, err := store.ParseSyncPolicy(*walSync)
+		if err != nil {
+			log.Fatal(err)
+		}
+		wal, err := store.OpenWAL(*walPath, policy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		storeOptions = append(storeOptions, store.WithWAL(wal))
+	}
+	s, err := newStore(*backend, *data, *delay, storeOptions...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Checkpoints are optional, restored before taking any request,
+	// the writes logged on the WAL after it are applied on top of it
+	var snapshotter store.Snapshotter
+	if *snapshotPath != "" {
+		var ok bool
+		if snapshotter, ok = s.(store.Snapshotter); !ok {
+			log.Fatalf("store %s does not support snapshots", *backend)
+		}
+		if err := store.LoadSnapshot(*snapshotPath, snapshotter); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Fatal(err)
+		}
+	}
+	hasher, err := app.NewHasher(*algorithm)
+	if err != nil {
+		log.Fatal(err)
+	}
+	options := []app.Option{app.WithHasher(hasher), app.WithSaltLength(*salt)}
+	if *pepperFile != "" {
+		pepper, err := app.LoadPepper(*pepperFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		options = append(options, app.WithPepper(pepper))
+	}
 	// Create a new Hashing Service and feed it to the http server
-	server := NewHTTPServer(service.NewHashingService(*delay, *logs))
+	application := app.New(s, options...)
+	server := NewHTTPServer(service.NewHashingService(application, *logs))
+	stop := func() {}
+	if snapshotter != nil && *snapshotInterval > 0 {
+		stop = snapshots(*snapshotPath, snapshotter, *snapshotInterval)
+	}
 	// Run will perform graceful shutdown
 	server.Run(*port)
+	// Pending writes were flushed by then, take the last checkpoint
+	stop()
+	if snapshotter != nil {
+		if err := store.SaveSnapshot(*snapshotPath, snapshotter); err != nil {
+			log.Println("Snapshot error:", err)
+		}
+	}
+}
+
+// usage reports an invalid flag value and exits, like flag.Parse does
+func usage(err error) {
+	fmt.Fprintln(flag.CommandLine.Output(), err)
+	flag.Usage()
+	os.Exit(2)
+}
+
+// checkSalt rejects salt lengths below the minimum, negative ones would
+// disable salting and every stored hash would look outdated (rehashed
+// on every verification). Zero is the only way to disable it.
+func checkSalt(n int) error {
+	if n != 0 && n < app.MIN_SALT_LENGTH {
+		return fmt.Errorf("invalid value %d for flag -salt: must be 0 or at least %d", n, app.MIN_SALT_LENGTH)
+	}
+	return nil
+}
+
+// snapshots saves a snapshot of s to path every interval on a go
+// routine, errors are logged and retried on the next tick. Returns a
+// function that stops the routine and waits for it to be done.
+func snapshots(path string, s store.Snapshotter, interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-ticker.C:
+				if err := store.SaveSnapshot(path, s); err != nil {
+					log.Println("Snapshot error:", err)
+				}
+			case <-quit:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// newStore creates the Store implementation selected by name
+func newStore(name, dir string, delay time.Duration, options ...store.Option) (store.Store, error) {
+	switch name {
+	case "memory":
+		return store.NewMemory(delay, options...), nil
+	case "sharded":
+		return store.NewSharded(delay, options...), nil
+	case "file":
+		return store.NewFile(dir, delay, options...)
+	case "btree":
+		return store.NewBTree(dir, delay, options...)
+	}
+	return nil, fmt.Errorf("unknown store: %s", name)
 }
@@ -0,0 +1,13 @@
+package main
+
+import "testing"
+
+// Salts shorter than the minimum are rejected, zero disables salting
+func TestCheckSalt(t *testing.T) {
+	valid := map[int]bool{-16: false, -1: false, 0: true, 1: false, 7: false, 8: true, 16: true, 64: true}
+	for n, want := range valid {
+		if have := checkSalt(n) == nil; have != want {
+			t.Errorf("salt %d: expected valid %v - got: %v", n, want, have)
+		}
+	}
+}
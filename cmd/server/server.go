@@ -33,6 +33,10 @@ func (s *Server) Run(port string) {
 		Addr:    ":" + port,
 		Handler: s.service.Handler(),
 	}
+	// End long lived connections (streams) once shutdown starts
+	if d, ok := s.service.(service.Drainer); ok {
+		server.RegisterOnShutdown(d.Drain)
+	}
 	// Start listening for http requests on a go routine
 	go func() {
 		log.Println("Server listening on port:", port)
@@ -42,7 +46,7 @@ func (s *Server) Run(port string) {
 	}()
 	// Create a new notification channel to listen to os.Signal
 	// interruptions like Ctrl+C to gracefully shutdown
-	interrupt := make(chan os.Signal)
+	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
 	// Block on either an OS interrupt or the service.Shutdown signal
 	// to start graceful shutdown.
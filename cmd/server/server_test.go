@@ -3,7 +3,6 @@ package main
 import (
 	"sync"
 	"testing"
-	"time"
 
 	"github.com/phrozen/password-hash-exercise/internal/service"
 )
@@ -25,9 +24,8 @@ func TestGracefulShutdown(t *testing.T) {
 		s.Run("3000")
 		wg.Done()
 	}()
-	// Wait a bit for server initialization to complete
-	time.Sleep(100 * time.Millisecond)
-	// Send the shutdown signal
+	// Send the shutdown signal, quit is unbuffered so
+	// this blocks until the server is listening for it
 	quit <- true
 	close(quit)
 	// Wait for server to shutdown
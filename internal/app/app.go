@@ -1,54 +1,263 @@
 package app
 
 import (
-	"crypto/sha512"
-	"encoding/base64"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"sync/atomic"
 
 	"github.com/phrozen/password-hash-exercise/internal/store"
 )
 
-// 512 bits / 8 = 64 bytes * 8 / 6 = 86
-// plus padding for a multiple of 4 = 88
-const HASH_LENGTH = 88
-
 // App (application) implements the core business logic based on requirements
 // which is to save hashed passwords and retrieve them later.
 type App struct {
-	store store.Store
+	store      store.Store
+	hasher     Hasher
+	saltLength int
+	pepper     *Pepper
+	rehashed   int64
+	state      store.Lifecycle
+}
+
+// Verification is the result of checking a password against a hash,
+// Rehashed tells if the hash was upgraded to the current settings.
+type Verification struct {
+	Match    bool
+	Rehashed bool
+}
+
+// Option configures optional application settings on New
+type Option func(*App)
+
+// WithHasher sets the password hashing algorithm, SHA512 by default
+func WithHasher(h Hasher) Option {
+	return func(app *App) {
+		app.hasher = h
+	}
+}
+
+// MIN_SALT_LENGTH is the shortest salt (in bytes) worth generating,
+// shorter ones are too easy to precompute tables for.
+const MIN_SALT_LENGTH = 8
+
+// WithSaltLength sets the size in bytes of the random salt generated
+// for every password, 16 by default, zero disables salting. It must be
+// at least MIN_SALT_LENGTH otherwise.
+func WithSaltLength(n int) Option {
+	return func(app *App) {
+		app.saltLength = n
+	}
+}
+
+// WithPepper mixes a server side secret into every password, the id
+// of the pepper key used is saved along with the hash.
+func WithPepper(p *Pepper) Option {
+	return func(app *App) {
+		app.pepper = p
+	}
 }
 
 // New creates an application with the given Store implementation
-func New(s store.Store) *App {
-	return &App{store: s}
+func New(s store.Store, options ...Option) *App {
+	app := &App{store: s, hasher: SHA512{}, saltLength: 16}
+	for _, option := range options {
+		option(app)
+	}
+	return app
 }
 
 // GetHash returns the hash at the given id from the Store
-func (app *App) GetHash(id int) (string, error) {
-	hash, err := app.store.Get(id)
+func (app *App) GetHash(ctx context.Context, id int) (string, error) {
+	hash, err := app.store.Get(ctx, id)
 	return string(hash), err
 }
 
-// SetHash receives a password to be hashed with SHA512 algorithm and
-// then converted to base64 encoding and saved to the Store, returns
-// the id where the hash is/will be saved.
-func (app *App) SetHash(password string) (int, error) {
-	hash := app.hash([]byte(password))
-	return app.store.Set(hash)
+// WaitHash returns the hash at the given id from the Store, waiting
+// for its delayed write if it is still pending until ctx is done.
+// Once ctx is done, the state of the hash at that point is returned.
+func (app *App) WaitHash(ctx context.Context, id int) (string, error) {
+	if err := app.store.Wait(ctx, id); err != nil && ctx.Err() == nil {
+		return "", err
+	}
+	// ctx is most likely done by now (the wait is over), but
+	// the current state must be read regardless
+	return app.GetHash(context.Background(), id)
+}
+
+// SetHash receives a password to be hashed with the configured algorithm
+// and then encoded as a PHC string and saved to the Store, returns
+// the id where the hash is/will be saved. Hashing is expensive, so
+// it is not even started if ctx is already done.
+func (app *App) SetHash(ctx context.Context, password string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	// Same goes for writes once draining or closed
+	if err := app.state.Writable(); err != nil {
+		return 0, err
+	}
+	hash, err := app.hash([]byte(password))
+	if err != nil {
+		return 0, err
+	}
+	return app.store.Set(ctx, hash)
+}
+
+// Verify checks password against the hash at the given id from the
+// Store, hashes are verified with the algorithm, parameters and pepper
+// key they were created with, regardless of the current configuration.
+// After a successful verification, hashes made with outdated settings
+// are transparently replaced with a new one using the current settings.
+// Store errors are returned as is, so callers can tell them apart.
+func (app *App) Verify(ctx context.Context, id int, password string) (Verification, error) {
+	result := Verification{}
+	hash, err := app.store.Get(ctx, id)
+	if err != nil {
+		return result, err
+	}
+	phc, err := ParsePHC(string(hash))
+	if err != nil {
+		return result, err
+	}
+	result.Match, err = app.verify(phc, []byte(password))
+	if err != nil || !result.Match || !app.outdated(phc) {
+		return result, err
+	}
+	// Upgrading is best effort, the password was verified regardless,
+	// it will be tried again on the next successful verification.
+	if ctx.Err() != nil || app.state.Writable() != nil {
+		return result, nil
+	}
+	if hash, err = app.hash([]byte(password)); err != nil {
+		return result, nil
+	}
+	if err = app.store.Update(ctx, id, hash); err != nil {
+		return result, nil
+	}
+	atomic.AddInt64(&app.rehashed, 1)
+	result.Rehashed = true
+	return result, nil
 }
 
-// Close runs all tear down operations like closing the Store
+// Rehashed returns the number of hashes upgraded on verification
+func (app *App) Rehashed() int64 {
+	return atomic.LoadInt64(&app.rehashed)
+}
+
+// Observe registers fn to be notified when a hash is accepted
+// and when it is persisted by the Store
+func (app *App) Observe(fn func(event string, id int)) {
+	app.store.Observe(fn)
+}
+
+// Size returns the number of hashes saved and pending in the Store
+func (app *App) Size() (saved, pending int) {
+	return app.store.Len(), app.store.Pending()
+}
+
+// State returns the lifecycle state of the application
+func (app *App) State() store.State {
+	return app.state.State()
+}
+
+// Drain rejects new hashes with store.ErrClosed from now on, while
+// pending writes are still done and hashes can still be read.
+func (app *App) Drain() {
+	app.state.Drain()
+}
+
+// Close runs all tear down operations like closing the Store,
+// it is safe to call it many times (so is closing the Store).
 func (app *App) Close() error {
-	return app.store.Close()
-}
-
-// hashes any input with SHA512 and encodes to standard base64
-// returned []byte has ALWAYS 88 bytes length and should never fail
-func (app *App) hash(input []byte) []byte {
-	hash := sha512.Sum512(input)
-	// Deterministic buffer size will improve
-	// performance, if slow, try sync.Pool
-	output := make([]byte, HASH_LENGTH)
-	// convert fixed size array 'hash' by slicing it
-	base64.StdEncoding.Encode(output, hash[:])
-	return output
+	app.state.Drain()
+	err := app.store.Close()
+	app.state.Close()
+	return err
+}
+
+// hashes any input with the configured Hasher and encodes it as
+// a PHC string, which carries the algorithm and its parameters
+// along with the hash so stored values can explain themselves.
+// A random salt is generated for every call and if a pepper is
+// set, the input is mixed with the current key beforehand.
+func (app *App) hash(input []byte) ([]byte, error) {
+	phc := PHC{
+		ID:      app.hasher.Name(),
+		Version: app.hasher.Version(),
+		Params:  app.hasher.Params(),
+	}
+	if app.pepper != nil {
+		id := app.pepper.Current()
+		mixed, err := app.pepper.mix(id, input)
+		if err != nil {
+			return nil, err
+		}
+		input = mixed
+		phc.Params = append(phc.Params, Param{Name: "kid", Value: id})
+	}
+	// Hashers with their own salt would just ignore it
+	if _, ok := app.hasher.(selfSalted); !ok && app.saltLength > 0 {
+		phc.Salt = make([]byte, app.saltLength)
+		if _, err := rand.Read(phc.Salt); err != nil {
+			return nil, err
+		}
+	}
+	key, err := app.hasher.Hash(input, phc.Salt)
+	if err != nil {
+		return nil, err
+	}
+	phc.Hash = key
+	return []byte(phc.String()), nil
+}
+
+// verify derives the key for input with the same settings found in phc
+// and compares it in constant time against the one in phc.
+func (app *App) verify(phc PHC, input []byte) (bool, error) {
+	hasher, err := hasherFor(phc)
+	if err != nil {
+		return false, err
+	}
+	if id, ok := phc.Param("kid"); ok {
+		if app.pepper == nil {
+			return false, fmt.Errorf("%w: %s", ErrUnknownKey, id)
+		}
+		if input, err = app.pepper.mix(id, input); err != nil {
+			return false, err
+		}
+	}
+	if h, ok := hasher.(selfSalted); ok {
+		return h.compare(phc.Hash, input)
+	}
+	key, err := hasher.Hash(input, phc.Salt)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, phc.Hash) == 1, nil
+}
+
+// outdated tells if phc was made with different settings than
+// the current ones: algorithm, cost, salt length or pepper key.
+func (app *App) outdated(phc PHC) bool {
+	if phc.Legacy || phc.ID != app.hasher.Name() || phc.Version != app.hasher.Version() {
+		return true
+	}
+	// Current params plus the pepper key, in the same order as hash
+	params := app.hasher.Params()
+	if app.pepper != nil {
+		params = append(params, Param{Name: "kid", Value: app.pepper.Current()})
+	}
+	if len(params) != len(phc.Params) {
+		return true
+	}
+	for i := range params {
+		if params[i] != phc.Params[i] {
+			return true
+		}
+	}
+	if _, ok := app.hasher.(selfSalted); ok {
+		return false
+	}
+	return len(phc.Salt) != app.saltLength
 }
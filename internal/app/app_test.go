@@ -1,12 +1,18 @@
 package app
 
 import (
+	"context"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"math/rand"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/phrozen/password-hash-exercise/internal/clock"
 	"github.com/phrozen/password-hash-exercise/internal/store"
 )
 
@@ -22,21 +28,74 @@ func equal(t *testing.T, want, have any) {
 }
 
 // Test with random input sizes and data, assert the resulting
-// hash is always the expected length, regardless of input.
+// hash is always a valid PHC string of the expected length.
 func TestHash(t *testing.T) {
-	app := &App{} // avoid Shutdown
+	app := New(nil) // no Store needed
 	for i := 0; i < 100; i++ {
 		password := make([]byte, rand.Intn(64)+1)
 		rand.Read(password)
-		hash := app.hash(password)
-		equal(t, HASH_LENGTH, len(hash))
+		hash, err := app.hash(password)
+		equal(t, nil, err)
+		phc, err := ParsePHC(string(hash))
+		equal(t, nil, err)
+		equal(t, "sha512", phc.ID)
+		equal(t, sha512.Size, len(phc.Hash))
 	}
 	// Test for zero and nil values
 	var pass []byte
-	hash := app.hash(pass)
-	equal(t, HASH_LENGTH, len(hash))
-	hash = app.hash(nil)
-	equal(t, HASH_LENGTH, len(hash))
+	empty, _ := app.hash(pass)
+	hash, _ := app.hash(nil)
+	// Random salts make every hash different
+	equal(t, false, string(empty) == string(hash))
+	phc, err := ParsePHC(string(hash))
+	equal(t, nil, err)
+	equal(t, sha512.Size, len(phc.Hash))
+}
+
+// Every algorithm should be usable from the application, cost
+// parameters are lowered to the minimum to keep tests fast.
+func TestHashers(t *testing.T) {
+	hashers := []Hasher{
+		SHA512{},
+		PBKDF2{Iterations: 1, KeyLength: 32},
+		Scrypt{N: 2, R: 1, P: 1, KeyLength: 32},
+		Argon2id{Time: 1, Memory: 8, Threads: 1, KeyLength: 32},
+		Bcrypt{Cost: 4},
+	}
+	for _, h := range hashers {
+		app := New(nil, WithHasher(h), WithSaltLength(0))
+		first, err := app.hash([]byte("password"))
+		equal(t, nil, err)
+		phc, err := ParsePHC(string(first))
+		equal(t, nil, err)
+		equal(t, h.Name(), phc.ID)
+		second, err := app.hash([]byte("password"))
+		equal(t, nil, err)
+		// bcrypt is the only one with its own random salt
+		equal(t, h.Name() != "bcrypt", string(first) == string(second))
+		// Salted hashes must always differ
+		app = New(nil, WithHasher(h))
+		first, _ = app.hash([]byte("password"))
+		second, _ = app.hash([]byte("password"))
+		equal(t, false, string(first) == string(second))
+	}
+	// bcrypt can't handle passwords longer than 72 bytes
+	app := New(nil, WithHasher(Bcrypt{Cost: 4}))
+	_, err := app.hash(make([]byte, 73))
+	equal(t, ErrPasswordTooLong, err)
+	_, err = Bcrypt{}.compare(nil, make([]byte, 73))
+	equal(t, ErrPasswordTooLong, err)
+}
+
+// Every name exposed for configuration maps to a Hasher
+func TestNewHasher(t *testing.T) {
+	for _, name := range []string{"sha512", "pbkdf2-sha512", "scrypt", "argon2id", "bcrypt"} {
+		h, err := NewHasher(name)
+		equal(t, nil, err)
+		equal(t, name, h.Name())
+	}
+	_, err := NewHasher("md5")
+	equal(t, true, err != nil)
 }
 
 // Kinda redundant with just a single Store implementation,
@@ -46,23 +105,200 @@ func TestSetGet(t *testing.T) {
 	defer app.Close()
 	for i := 1; i <= 100; i++ {
 		input := fmt.Sprintf("password-%d", i)
-		index, err := app.SetHash(input)
+		index, err := app.SetHash(context.Background(), input)
 		equal(t, err, nil)
 		equal(t, index, i)
-		// Even with 0 delay, scheduler needs time for
-		// context switching, 1ms should be enough
-		// but we use higher values for slow machines
-		time.Sleep(10 * time.Millisecond)
-		output, err := app.GetHash(i)
+		// Even with 0 delay the write lands on the scheduler
+		output, err := app.WaitHash(context.Background(), i)
 		equal(t, err, nil)
-		equal(t, HASH_LENGTH, len(output))
+		_, err = ParsePHC(output)
+		equal(t, nil, err)
 	}
 }
 
+// Callers without a context keep working through the adapter
+func TestBackground(t *testing.T) {
+	app := NewBackground(New(store.NewMemory(0)))
+	defer app.Close()
+	id, err := app.SetHash("password")
+	equal(t, nil, err)
+	_, err = app.WaitHash(context.Background(), id)
+	equal(t, nil, err)
+	hash, err := app.GetHash(id)
+	equal(t, nil, err)
+	_, err = ParsePHC(hash)
+	equal(t, nil, err)
+	result, err := app.Verify(id, "password")
+	equal(t, nil, err)
+	equal(t, true, result.Match)
+}
+
+// Done contexts stop the work before hashing or touching the Store
+func TestCancel(t *testing.T) {
+	app := New(store.NewMemory(0))
+	defer app.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := app.SetHash(ctx, "password")
+	equal(t, context.Canceled, err)
+	saved, pending := app.Size()
+	equal(t, 0, saved+pending)
+	id, _ := app.SetHash(context.Background(), "password")
+	equal(t, 1, id)
+	equal(t, nil, app.store.Wait(context.Background(), id))
+	_, err = app.GetHash(ctx, id)
+	equal(t, context.Canceled, err)
+	_, err = app.Verify(ctx, id, "password")
+	equal(t, context.Canceled, err)
+	// The wait is cut short, but the hash is still read
+	hash, err := app.WaitHash(ctx, id)
+	equal(t, nil, err)
+	equal(t, true, hash != "")
+}
+
+// New hashes are rejected once draining, Close is safe to call again
+func TestClose(t *testing.T) {
+	c := clock.NewFake(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	app := New(store.NewMemory(10*time.Millisecond, store.WithClock(c)))
+	id, _ := app.SetHash(context.Background(), "password")
+	app.Drain()
+	equal(t, store.STATE_DRAINING, app.State())
+	_, err := app.SetHash(context.Background(), "password")
+	equal(t, store.ErrClosed, err)
+	// Pending writes are still done
+	c.Advance(10 * time.Millisecond)
+	hash, err := app.WaitHash(context.Background(), id)
+	equal(t, nil, err)
+	equal(t, true, hash != "")
+	equal(t, nil, app.Close())
+	equal(t, nil, app.Close())
+	equal(t, store.STATE_CLOSED, app.State())
+}
+
+// Hashes must verify with the settings they were created with
+func TestVerify(t *testing.T) {
+	hashers := []Hasher{
+		SHA512{},
+		PBKDF2{Iterations: 1, KeyLength: 32},
+		Scrypt{N: 2, R: 1, P: 1, KeyLength: 32},
+		Argon2id{Time: 1, Memory: 8, Threads: 1, KeyLength: 32},
+		Bcrypt{Cost: 4},
+	}
+	pepper, _ := ReadPepper(strings.NewReader("k1:c2VjcmV0LW9uZQ=="))
+	for _, h := range hashers {
+		for _, options := range [][]Option{{}, {WithPepper(pepper)}} {
+			app := New(nil, append(options, WithHasher(h))...)
+			hash, err := app.hash([]byte("password"))
+			equal(t, nil, err)
+			phc, err := ParsePHC(string(hash))
+			equal(t, nil, err)
+			// A default app must verify it too (different settings)
+			verifier := New(nil, WithPepper(pepper))
+			match, err := verifier.verify(phc, []byte("password"))
+			equal(t, nil, err)
+			equal(t, true, match)
+			match, err = verifier.verify(phc, []byte("Password"))
+			equal(t, nil, err)
+			equal(t, false, match)
+		}
+	}
+	// Legacy SHA512 hashes have no salt
+	digest := sha512.Sum512([]byte("password"))
+	legacy, _ := ParsePHC(base64.StdEncoding.EncodeToString(digest[:]))
+	match, err := New(nil).verify(legacy, []byte("password"))
+	equal(t, nil, err)
+	equal(t, true, match)
+	// Peppered hashes can't be verified without the key
+	hash, _ := New(nil, WithPepper(pepper)).hash([]byte("password"))
+	phc, _ := ParsePHC(string(hash))
+	_, err = New(nil).verify(phc, []byte("password"))
+	equal(t, true, errors.Is(err, ErrUnknownKey))
+	// Unknown algorithms and invalid parameters
+	cases := []string{
+		"$md5$$aGFzaA",
+		"$pbkdf2-sha512$c2FsdA$aGFzaA",
+		"$pbkdf2-sha512$i=x$c2FsdA$aGFzaA",
+		"$scrypt$ln=40,r=8,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=16$m=8,t=1,p=1$c2FsdA$aGFzaA",
+		// Out of range parameters must not be truncated (p=256 is 0)
+		"$argon2id$v=19$m=8,t=1,p=256$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=8,t=1,p=0$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=4294967296,t=1,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=8,t=0,p=1$c2FsdA$aGFzaA",
+	}
+	for _, c := range cases {
+		phc, err := ParsePHC(c)
+		equal(t, nil, err)
+		_, err = New(nil).verify(phc, []byte("password"))
+		equal(t, true, errors.Is(err, ErrInvalidPHC))
+	}
+}
+
+// Old pepper keys must keep working after rotation
+func TestVerifyRotation(t *testing.T) {
+	s := store.NewMemory(0)
+	old, _ := ReadPepper(strings.NewReader("k1:c2VjcmV0LW9uZQ=="))
+	id, err := New(s, WithPepper(old)).SetHash(context.Background(), "password")
+	equal(t, nil, err)
+	s.Wait(context.Background(), id)
+	rotated, _ := ReadPepper(strings.NewReader("k1:c2VjcmV0LW9uZQ==\nk2:c2VjcmV0LXR3bw=="))
+	app := New(s, WithPepper(rotated))
+	result, err := app.Verify(context.Background(), id, "password")
+	equal(t, nil, err)
+	equal(t, true, result.Match)
+	// Hash is upgraded to the current key
+	equal(t, true, result.Rehashed)
+	hash, _ := app.GetHash(context.Background(), id)
+	phc, _ := ParsePHC(hash)
+	kid, _ := phc.Param("kid")
+	equal(t, "k2", kid)
+	// Store errors are returned as is
+	_, err = app.Verify(context.Background(), id+1, "password")
+	equal(t, store.ErrNotFound, err)
+	pending := New(store.NewMemory(time.Second, store.WithClock(clock.NewFake(time.Now()))))
+	id, _ = pending.SetHash(context.Background(), "password")
+	_, err = pending.Verify(context.Background(), id, "password")
+	equal(t, true, errors.Is(err, store.ErrPending))
+}
+
+// Hashes with outdated settings are upgraded after a successful
+// verification and only then, current ones are left untouched
+func TestVerifyRehash(t *testing.T) {
+	s := store.NewMemory(0)
+	defer s.Close()
+	// Legacy SHA512 digest saved by previous versions
+	digest := sha512.Sum512([]byte("password"))
+	id, _ := s.Set(context.Background(), []byte(base64.StdEncoding.EncodeToString(digest[:])))
+	s.Wait(context.Background(), id)
+
+	app := New(s, WithHasher(PBKDF2{Iterations: 1, KeyLength: 32}))
+	result, err := app.Verify(context.Background(), id, "wrong")
+	equal(t, nil, err)
+	equal(t, Verification{}, result)
+	result, err = app.Verify(context.Background(), id, "password")
+	equal(t, nil, err)
+	equal(t, Verification{Match: true, Rehashed: true}, result)
+	hash, _ := app.GetHash(context.Background(), id)
+	phc, _ := ParsePHC(hash)
+	equal(t, "pbkdf2-sha512", phc.ID)
+	// Already up to date
+	result, _ = app.Verify(context.Background(), id, "password")
+	equal(t, Verification{Match: true}, result)
+	// Raising the cost upgrades it again
+	app = New(s, WithHasher(PBKDF2{Iterations: 2, KeyLength: 32}))
+	result, _ = app.Verify(context.Background(), id, "password")
+	equal(t, Verification{Match: true, Rehashed: true}, result)
+	// Changing salt length too
+	app = New(s, WithHasher(PBKDF2{Iterations: 2, KeyLength: 32}), WithSaltLength(8))
+	result, _ = app.Verify(context.Background(), id, "password")
+	equal(t, Verification{Match: true, Rehashed: true}, result)
+	equal(t, int64(1), app.Rehashed())
+}
+
 // Shows consistent performance up to 64 byte inputs (common use case)
 // Implementation has consistent allocs and memory usage (deterministic)
 func BenchmarkHash(b *testing.B) {
-	app := &App{} // avoid Shutdown
+	app := New(nil) // no Store needed
 	for s := 8; s <= 1024; s = s << 1 {
 		password := make([]byte, s)
 		rand.Read(password)
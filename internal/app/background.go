@@ -0,0 +1,31 @@
+package app
+
+import "context"
+
+// Background adapts an App for callers written before operations
+// took a context, every operation runs with context.Background()
+// so it can't be cancelled, just like it used to be (same as the
+// store.Background adapter).
+type Background struct {
+	*App
+}
+
+// NewBackground returns the adapter for the given App
+func NewBackground(app *App) Background {
+	return Background{app}
+}
+
+// GetHash returns the hash saved at id, see App
+func (b Background) GetHash(id int) (string, error) {
+	return b.App.GetHash(context.Background(), id)
+}
+
+// SetHash hashes the password and returns its id, see App
+func (b Background) SetHash(password string) (int, error) {
+	return b.App.SetHash(context.Background(), password)
+}
+
+// Verify checks the password against the hash at id, see App
+func (b Background) Verify(id int, password string) (Verification, error) {
+	return b.App.Verify(context.Background(), id, password)
+}
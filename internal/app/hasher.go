@@ -0,0 +1,279 @@
+package app
+
+import (
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"strconv"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Hasher abstracts the password hashing algorithm so it can be
+// chosen (along with its cost parameters) per application.
+type Hasher interface {
+	// Name returns the algorithm identifier
+	Name() string
+	// Version of the algorithm, zero if it is not versioned
+	Version() int
+	// Params returns the cost parameters to be encoded with the hash
+	Params() []Param
+	// Hash derives the key for password and salt
+	Hash(password, salt []byte) ([]byte, error)
+}
+
+// selfSalted is implemented by hashers that generate (and embed) their
+// own salt, as the same key can't be derived again it is compared instead.
+type selfSalted interface {
+	compare(key, password []byte) (bool, error)
+}
+
+// NewHasher returns the Hasher for the algorithm name with its
+// default cost parameters, useful for configuration from flags.
+func NewHasher(name string) (Hasher, error) {
+	switch name {
+	case "sha512":
+		return SHA512{}, nil
+	case "pbkdf2-sha512":
+		return NewPBKDF2(), nil
+	case "scrypt":
+		return NewScrypt(), nil
+	case "argon2id":
+		return NewArgon2id(), nil
+	case "bcrypt":
+		return NewBcrypt(), nil
+	}
+	return nil, fmt.Errorf("unknown hash algorithm: %s", name)
+}
+
+// hasherFor returns the Hasher that produced phc with the same cost
+// parameters, so the key can be derived again for verification.
+func hasherFor(phc PHC) (Hasher, error) {
+	var err error
+	// Parses an integer parameter keeping the first error
+	param := func(name string) int {
+		value, ok := phc.Param(name)
+		if !ok {
+			err = fmt.Errorf("%w: missing %s parameter", ErrInvalidPHC, name)
+			return 0
+		}
+		n, e := strconv.Atoi(value)
+		if e != nil || n <= 0 {
+			err = fmt.Errorf("%w: invalid %s parameter", ErrInvalidPHC, name)
+		}
+		return n
+	}
+	// Parses a parameter that must fit a narrower type, so it
+	// is rejected instead of truncated (wrapping around to 0)
+	bounded := func(name string, max int) int {
+		n := param(name)
+		if err == nil && n > max {
+			err = fmt.Errorf("%w: invalid %s parameter", ErrInvalidPHC, name)
+		}
+		return n
+	}
+	var h Hasher
+	switch phc.ID {
+	case "sha512":
+		h = SHA512{}
+	case "pbkdf2-sha512":
+		h = PBKDF2{Iterations: param("i"), KeyLength: len(phc.Hash)}
+	case "scrypt":
+		ln := param("ln")
+		// Keep N within int range on every platform
+		if ln >= 31 {
+			return nil, fmt.Errorf("%w: invalid ln parameter", ErrInvalidPHC)
+		}
+		h = Scrypt{N: 1 << ln, R: param("r"), P: param("p"), KeyLength: len(phc.Hash)}
+	case "argon2id":
+		if phc.Version != argon2.Version {
+			return nil, fmt.Errorf("%w: unsupported argon2id version %d", ErrInvalidPHC, phc.Version)
+		}
+		h = Argon2id{
+			Memory:    uint32(bounded("m", math.MaxUint32)),
+			Time:      uint32(bounded("t", math.MaxUint32)),
+			Threads:   uint8(bounded("p", math.MaxUint8)),
+			KeyLength: uint32(len(phc.Hash)),
+		}
+	case "bcrypt":
+		h = Bcrypt{Cost: param("cost")}
+	default:
+		return nil, fmt.Errorf("%w: unknown algorithm %s", ErrInvalidPHC, phc.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// SHA512 is a single round of SHA512, kept as the default for
+// compatibility with the original requirements. It is fast by
+// design, which makes it a poor choice for passwords.
+type SHA512 struct{}
+
+func (SHA512) Name() string {
+	return "sha512"
+}
+
+func (SHA512) Version() int {
+	return 0
+}
+
+func (SHA512) Params() []Param {
+	return nil
+}
+
+func (SHA512) Hash(password, salt []byte) ([]byte, error) {
+	h := sha512.New()
+	h.Write(salt)
+	h.Write(password)
+	return h.Sum(nil), nil
+}
+
+// PBKDF2 with HMAC-SHA512 as pseudorandom function
+type PBKDF2 struct {
+	Iterations int
+	KeyLength  int
+}
+
+// NewPBKDF2 returns PBKDF2 with OWASP recommended iterations
+func NewPBKDF2() PBKDF2 {
+	return PBKDF2{Iterations: 210000, KeyLength: 64}
+}
+
+func (PBKDF2) Name() string {
+	return "pbkdf2-sha512"
+}
+
+func (PBKDF2) Version() int {
+	return 0
+}
+
+func (h PBKDF2) Params() []Param {
+	return []Param{{Name: "i", Value: strconv.Itoa(h.Iterations)}}
+}
+
+func (h PBKDF2) Hash(password, salt []byte) ([]byte, error) {
+	return pbkdf2.Key(password, salt, h.Iterations, h.KeyLength, sha512.New), nil
+}
+
+// Scrypt key derivation, N is the CPU/memory cost (power of 2),
+// R the block size and P the parallelization.
+type Scrypt struct {
+	N         int
+	R         int
+	P         int
+	KeyLength int
+}
+
+// NewScrypt returns scrypt with OWASP recommended parameters
+func NewScrypt() Scrypt {
+	return Scrypt{N: 1 << 15, R: 8, P: 1, KeyLength: 64}
+}
+
+func (Scrypt) Name() string {
+	return "scrypt"
+}
+
+func (Scrypt) Version() int {
+	return 0
+}
+
+// Params encodes N as its base 2 logarithm (ln) by convention
+func (h Scrypt) Params() []Param {
+	return []Param{
+		{Name: "ln", Value: strconv.Itoa(bits.Len(uint(h.N)) - 1)},
+		{Name: "r", Value: strconv.Itoa(h.R)},
+		{Name: "p", Value: strconv.Itoa(h.P)},
+	}
+}
+
+func (h Scrypt) Hash(password, salt []byte) ([]byte, error) {
+	return scrypt.Key(password, salt, h.N, h.R, h.P, h.KeyLength)
+}
+
+// Argon2id key derivation, Memory is expressed in KiB
+type Argon2id struct {
+	Time      uint32
+	Memory    uint32
+	Threads   uint8
+	KeyLength uint32
+}
+
+// NewArgon2id returns Argon2id with OWASP recommended parameters
+func NewArgon2id() Argon2id {
+	return Argon2id{Time: 2, Memory: 19 * 1024, Threads: 1, KeyLength: 32}
+}
+
+func (Argon2id) Name() string {
+	return "argon2id"
+}
+
+func (Argon2id) Version() int {
+	return argon2.Version
+}
+
+func (h Argon2id) Params() []Param {
+	return []Param{
+		{Name: "m", Value: strconv.FormatUint(uint64(h.Memory), 10)},
+		{Name: "t", Value: strconv.FormatUint(uint64(h.Time), 10)},
+		{Name: "p", Value: strconv.FormatUint(uint64(h.Threads), 10)},
+	}
+}
+
+func (h Argon2id) Hash(password, salt []byte) ([]byte, error) {
+	return argon2.IDKey(password, salt, h.Time, h.Memory, h.Threads, h.KeyLength), nil
+}
+
+// Bcrypt generates and embeds its own random salt, so the given
+// salt is ignored and the key returned is the full bcrypt string.
+// Passwords longer than 72 bytes are rejected by the algorithm.
+type Bcrypt struct {
+	Cost int
+}
+
+// ErrPasswordTooLong is returned by hashers with a limit on the
+// password length (bcrypt only uses the first 72 bytes).
+var ErrPasswordTooLong = errors.New("password too long")
+
+// NewBcrypt returns bcrypt with the library default cost
+func NewBcrypt() Bcrypt {
+	return Bcrypt{Cost: bcrypt.DefaultCost}
+}
+
+func (Bcrypt) Name() string {
+	return "bcrypt"
+}
+
+func (Bcrypt) Version() int {
+	return 0
+}
+
+func (h Bcrypt) Params() []Param {
+	return []Param{{Name: "cost", Value: strconv.Itoa(h.Cost)}}
+}
+
+func (Bcrypt) compare(key, password []byte) (bool, error) {
+	// Would be truncated, matching any password sharing the first 72 bytes
+	if len(password) > 72 {
+		return false, ErrPasswordTooLong
+	}
+	err := bcrypt.CompareHashAndPassword(key, password)
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h Bcrypt) Hash(password, salt []byte) ([]byte, error) {
+	key, err := bcrypt.GenerateFromPassword(password, h.Cost)
+	if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		return nil, ErrPasswordTooLong
+	}
+	return key, err
+}
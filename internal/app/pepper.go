@@ -0,0 +1,93 @@
+package app
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Key ids are saved as a PHC parameter value, so they are restricted
+// to the characters allowed by the format.
+var keyIDRe = regexp.MustCompile(`^[A-Za-z0-9.-]+$`)
+
+// ErrUnknownKey is returned when a hash references a pepper key
+// that is not (or no longer) in the key file.
+var ErrUnknownKey = errors.New("unknown pepper key")
+
+// Pepper is a server side secret mixed into every password with
+// HMAC-SHA512 before hashing, so a leaked Store alone is not enough
+// to run an offline attack. Keys are identified by an id that is
+// saved with each hash, which allows rotating the current key while
+// hashes made with older keys can still be verified.
+type Pepper struct {
+	current string
+	keys    map[string][]byte
+}
+
+// LoadPepper reads the pepper keys from the file at path
+func LoadPepper(path string) (*Pepper, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadPepper(file)
+}
+
+// ReadPepper parses pepper keys, one per line as <id>:<base64 key>,
+// empty lines and lines starting with # are ignored. The last key is
+// the current one, so rotation is done by appending a new line and
+// keeping the old ones around.
+func ReadPepper(r io.Reader) (*Pepper, error) {
+	p := &Pepper{keys: make(map[string][]byte)}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(line, ":")
+		if !ok || !keyIDRe.MatchString(id) {
+			return nil, fmt.Errorf("pepper line %d: invalid key id", n)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(key) == 0 {
+			return nil, fmt.Errorf("pepper line %d: invalid key", n)
+		}
+		if _, ok := p.keys[id]; ok {
+			return nil, fmt.Errorf("pepper line %d: duplicated key id %s", n, id)
+		}
+		p.keys[id] = key
+		p.current = id
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if p.current == "" {
+		return nil, errors.New("pepper: no keys found")
+	}
+	return p, nil
+}
+
+// Current returns the id of the key used for new hashes
+func (p *Pepper) Current() string {
+	return p.current
+}
+
+// mix returns the HMAC-SHA512 of password with the key id
+func (p *Pepper) mix(id string, password []byte) ([]byte, error) {
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+	mac := hmac.New(sha512.New, key)
+	mac.Write(password)
+	return mac.Sum(nil), nil
+}
@@ -0,0 +1,73 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const keyFile = `
+# first key
+k1:c2VjcmV0LW9uZQ==
+
+k2:c2VjcmV0LXR3bw==
+`
+
+func TestReadPepper(t *testing.T) {
+	p, err := ReadPepper(strings.NewReader(keyFile))
+	equal(t, nil, err)
+	// Last key is the current one
+	equal(t, "k2", p.Current())
+	// Old keys are still available after rotation
+	old, err := p.mix("k1", []byte("password"))
+	equal(t, nil, err)
+	current, err := p.mix("k2", []byte("password"))
+	equal(t, nil, err)
+	equal(t, false, string(old) == string(current))
+	_, err = p.mix("k3", []byte("password"))
+	equal(t, true, err != nil)
+
+	cases := []string{
+		"",                     // No keys
+		"# comment only",       // No keys
+		"k1",                   // Missing key
+		"k$1:c2VjcmV0",         // Invalid id
+		"k1:!!!",               // Invalid base64
+		"k1:",                  // Empty key
+		"k1:c2VjcmV0\nk1:c2Vj", // Duplicated id
+	}
+	for _, c := range cases {
+		_, err := ReadPepper(strings.NewReader(c))
+		equal(t, true, err != nil)
+	}
+}
+
+func TestLoadPepper(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pepper")
+	equal(t, nil, os.WriteFile(path, []byte(keyFile), 0600))
+	p, err := LoadPepper(path)
+	equal(t, nil, err)
+	equal(t, "k2", p.Current())
+	_, err = LoadPepper(path + ".missing")
+	equal(t, true, err != nil)
+}
+
+// Hashes carry the id of the pepper key and depend on it
+func TestHashPepper(t *testing.T) {
+	p, _ := ReadPepper(strings.NewReader(keyFile))
+	for _, h := range []Hasher{SHA512{}, Bcrypt{Cost: 4}} {
+		app := New(nil, WithHasher(h), WithPepper(p))
+		hash, err := app.hash([]byte("password"))
+		equal(t, nil, err)
+		phc, err := ParsePHC(string(hash))
+		equal(t, nil, err)
+		equal(t, h.Name(), phc.ID)
+		kid, _ := phc.Param("kid")
+		equal(t, "k2", kid)
+	}
+	// Same salt, different pepper, different hash
+	plain, _ := New(nil, WithSaltLength(0)).hash([]byte("password"))
+	peppered, _ := New(nil, WithSaltLength(0), WithPepper(p)).hash([]byte("password"))
+	equal(t, false, string(plain) == string(peppered))
+}
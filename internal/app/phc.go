@@ -0,0 +1,164 @@
+package app
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 512 bits / 8 = 64 bytes * 8 / 6 = 86
+// plus padding for a multiple of 4 = 88
+// Length of the bare base64 SHA512 digests saved before PHC
+// encoding was introduced, used to recognize legacy values.
+const legacyLength = 88
+
+// PHC strings use standard base64 without padding
+var b64 = base64.RawStdEncoding
+
+// ErrInvalidPHC is returned when parsing a malformed hash string
+var ErrInvalidPHC = errors.New("invalid PHC string")
+
+// Param is a single name=value pair of the PHC parameters segment,
+// a slice is used instead of a map to keep a deterministic order.
+type Param struct {
+	Name  string
+	Value string
+}
+
+// PHC is a self describing password hash, following the PHC string format
+// https://github.com/P-H-C/phc-string-format/blob/master/phc-sf-spec.md
+//
+//	$<id>[$v=<version>][$<param>=<value>(,<param>=<value>)*][$<salt>[$<hash>]]
+//
+// Two other formats are recognized when parsing:
+//   - Legacy: bare base64 SHA512 digests (88 bytes) with no salt.
+//   - bcrypt: the modular crypt format ($2b$<cost>$<salt+hash>) which
+//     is kept as is, the whole string is held in Hash. It is only encoded
+//     in PHC format when it needs more parameters than its cost (pepper).
+type PHC struct {
+	ID      string
+	Version int
+	Params  []Param
+	Salt    []byte
+	Hash    []byte
+	Legacy  bool
+}
+
+// Param returns the value of the parameter name and if it was found
+func (p PHC) Param(name string) (string, bool) {
+	for _, param := range p.Params {
+		if param.Name == name {
+			return param.Value, true
+		}
+	}
+	return "", false
+}
+
+// String encodes the hash in its string format
+func (p PHC) String() string {
+	if p.Legacy {
+		return base64.StdEncoding.EncodeToString(p.Hash)
+	}
+	if p.ID == "bcrypt" && len(p.Params) <= 1 {
+		return string(p.Hash)
+	}
+	var sb strings.Builder
+	sb.WriteString("$")
+	sb.WriteString(p.ID)
+	if p.Version > 0 {
+		fmt.Fprintf(&sb, "$v=%d", p.Version)
+	}
+	if len(p.Params) > 0 {
+		sb.WriteString("$")
+		for i, param := range p.Params {
+			if i > 0 {
+				sb.WriteString(",")
+			}
+			sb.WriteString(param.Name)
+			sb.WriteString("=")
+			sb.WriteString(param.Value)
+		}
+	}
+	sb.WriteString("$")
+	sb.WriteString(b64.EncodeToString(p.Salt))
+	sb.WriteString("$")
+	sb.WriteString(b64.EncodeToString(p.Hash))
+	return sb.String()
+}
+
+// ParsePHC decodes a hash string in any of the recognized formats
+func ParsePHC(s string) (PHC, error) {
+	switch {
+	case len(s) == legacyLength && !strings.HasPrefix(s, "$"):
+		return parseLegacy(s)
+	case strings.HasPrefix(s, "$2a$"), strings.HasPrefix(s, "$2b$"), strings.HasPrefix(s, "$2y$"):
+		return parseBcrypt(s)
+	}
+	// Leading '$' produces an empty first field
+	fields := strings.Split(s, "$")
+	if len(fields) < 4 || fields[0] != "" || fields[1] == "" {
+		return PHC{}, ErrInvalidPHC
+	}
+	p := PHC{ID: fields[1]}
+	// Salt and hash are always the last two fields, the
+	// optional version and parameters are in between.
+	fields, salt, hash := fields[2:len(fields)-2], fields[len(fields)-2], fields[len(fields)-1]
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "v=") {
+		version, err := strconv.Atoi(fields[0][2:])
+		if err != nil {
+			return PHC{}, ErrInvalidPHC
+		}
+		p.Version = version
+		fields = fields[1:]
+	}
+	switch len(fields) {
+	case 0:
+	case 1:
+		for _, pair := range strings.Split(fields[0], ",") {
+			name, value, ok := strings.Cut(pair, "=")
+			if !ok || name == "" {
+				return PHC{}, ErrInvalidPHC
+			}
+			p.Params = append(p.Params, Param{Name: name, Value: value})
+		}
+	default:
+		return PHC{}, ErrInvalidPHC
+	}
+	var err error
+	if p.Salt, err = b64.DecodeString(salt); err != nil {
+		return PHC{}, ErrInvalidPHC
+	}
+	if p.Hash, err = b64.DecodeString(hash); err != nil || len(p.Hash) == 0 {
+		return PHC{}, ErrInvalidPHC
+	}
+	return p, nil
+}
+
+// parseLegacy decodes a bare base64 SHA512 digest
+func parseLegacy(s string) (PHC, error) {
+	hash, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return PHC{}, ErrInvalidPHC
+	}
+	return PHC{ID: "sha512", Hash: hash, Legacy: true}, nil
+}
+
+// parseBcrypt extracts the cost of a bcrypt hash, the hash itself
+// is kept untouched as verification is left to the bcrypt package.
+func parseBcrypt(s string) (PHC, error) {
+	// $2b$<cost>$<22 chars salt><31 chars hash>
+	fields := strings.Split(s, "$")
+	if len(fields) != 4 || len(fields[3]) != 53 {
+		return PHC{}, ErrInvalidPHC
+	}
+	if _, err := strconv.Atoi(fields[2]); err != nil {
+		return PHC{}, ErrInvalidPHC
+	}
+	return PHC{
+		ID:     "bcrypt",
+		Params: []Param{{Name: "cost", Value: strings.TrimLeft(fields[2], "0")}},
+		Hash:   []byte(s),
+	}, nil
+}
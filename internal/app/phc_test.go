@@ -0,0 +1,82 @@
+package app
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Encoding and decoding must be symmetric for every field
+func TestPHCRoundTrip(t *testing.T) {
+	cases := []PHC{
+		{ID: "sha512", Salt: []byte("salt"), Hash: []byte("hash")},
+		{ID: "pbkdf2-sha512", Params: []Param{{"i", "1000"}}, Salt: []byte("salt"), Hash: []byte("hash")},
+		{ID: "argon2id", Version: 19, Params: []Param{{"m", "8"}, {"t", "1"}, {"p", "1"}}, Salt: []byte("salt"), Hash: []byte("hash")},
+		{ID: "sha512", Hash: []byte("no salt")},
+	}
+	for _, want := range cases {
+		have, err := ParsePHC(want.String())
+		equal(t, nil, err)
+		equal(t, want.String(), have.String())
+		equal(t, want.ID, have.ID)
+		equal(t, want.Version, have.Version)
+		equal(t, len(want.Params), len(have.Params))
+		equal(t, string(want.Salt), string(have.Salt))
+		equal(t, string(want.Hash), string(have.Hash))
+	}
+	phc, _ := ParsePHC("$argon2id$v=19$m=8,t=1,p=1$c2FsdA$aGFzaA")
+	value, ok := phc.Param("m")
+	equal(t, true, ok)
+	equal(t, "8", value)
+	_, ok = phc.Param("x")
+	equal(t, false, ok)
+}
+
+// Bare base64 SHA512 digests are recognized as legacy
+func TestPHCLegacy(t *testing.T) {
+	digest := sha512.Sum512([]byte("password"))
+	legacy := base64.StdEncoding.EncodeToString(digest[:])
+	phc, err := ParsePHC(legacy)
+	equal(t, nil, err)
+	equal(t, true, phc.Legacy)
+	equal(t, "sha512", phc.ID)
+	equal(t, string(digest[:]), string(phc.Hash))
+	equal(t, legacy, phc.String())
+}
+
+// bcrypt strings are kept in their own format
+func TestPHCBcrypt(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), 4)
+	equal(t, nil, err)
+	phc, err := ParsePHC(string(hash))
+	equal(t, nil, err)
+	equal(t, "bcrypt", phc.ID)
+	cost, _ := phc.Param("cost")
+	equal(t, "4", cost)
+	equal(t, string(hash), phc.String())
+}
+
+func TestPHCInvalid(t *testing.T) {
+	cases := []string{
+		"",
+		"plain",
+		"$",
+		"$sha512",
+		"$$c2FsdA$aGFzaA",
+		"$sha512$c2FsdA$",
+		"$sha512$c2FsdA$!!!",
+		"$sha512$!!!$aGFzaA",
+		"$argon2id$v=x$m=8$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=8$t=1$c2FsdA$aGFzaA",
+		"$2b$xx$" + string(make([]byte, 53)),
+		"$2b$10$short",
+		string(make([]byte, legacyLength)),
+	}
+	for _, s := range cases {
+		_, err := ParsePHC(s)
+		equal(t, ErrInvalidPHC, err)
+	}
+}
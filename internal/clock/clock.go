@@ -0,0 +1,175 @@
+/*
+Clock package abstracts time so it can be injected where it matters
+(delayed writes, stats, logs), the Real clock is backed by the time
+package and the Fake one only moves when told to (Advance), making
+tests deterministic without sleeping.
+
+Timers take absolute deadlines instead of durations, so a deadline
+computed from Now can't be pushed back by a clock that moved between
+reading Now and setting the timer.
+*/
+package clock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and creates timers
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	NewTimer(at time.Time) Timer
+}
+
+// Timer sends the time on C once the clock reaches its deadline
+type Timer interface {
+	C() <-chan time.Time
+	Reset(at time.Time)
+	Stop()
+}
+
+// Real clock backed by the time package
+type Real struct{}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+func (Real) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (Real) NewTimer(at time.Time) Timer {
+	return &realTimer{time.NewTimer(time.Until(at))}
+}
+
+// WithTimeout returns a copy of parent that is canceled once d elapses
+// on c, like context.WithTimeout but driven by c so fakes expire it too.
+// Call cancel once done to release its timer.
+func WithTimeout(parent context.Context, c Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	timer := c.NewTimer(c.Now().Add(d))
+	go func() {
+		select {
+		case <-timer.C():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		timer.Stop()
+		cancel()
+	}
+}
+
+// realTimer adapts a time.Timer to absolute deadlines
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (t *realTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t *realTimer) Reset(at time.Time) {
+	t.timer.Reset(time.Until(at))
+}
+
+func (t *realTimer) Stop() {
+	t.timer.Stop()
+}
+
+// Fake clock that only moves with Advance, safe for concurrent use
+type Fake struct {
+	sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers map[*fakeTimer]struct{}
+}
+
+// NewFake returns a fake clock stopped at now
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now, timers: make(map[*fakeTimer]struct{})}
+	f.cond = sync.NewCond(&f.Mutex)
+	return f
+}
+
+func (f *Fake) Now() time.Time {
+	f.Lock()
+	defer f.Unlock()
+	return f.now
+}
+
+func (f *Fake) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+func (f *Fake) NewTimer(at time.Time) Timer {
+	t := &fakeTimer{fake: f, ch: make(chan time.Time, 1)}
+	t.Reset(at)
+	return t
+}
+
+// Advance moves the clock forward by d, firing every timer due
+func (f *Fake) Advance(d time.Duration) {
+	f.Lock()
+	defer f.Unlock()
+	f.now = f.now.Add(d)
+	for t := range f.timers {
+		if !t.at.After(f.now) {
+			f.fire(t)
+		}
+	}
+}
+
+// BlockUntil blocks until n timers are waiting for the clock, so tests
+// only Advance once the code under test set the deadlines it is after
+func (f *Fake) BlockUntil(n int) {
+	f.Lock()
+	defer f.Unlock()
+	for len(f.timers) < n {
+		f.cond.Wait()
+	}
+}
+
+// fire sends the time on a timer and forgets about it, must be
+// called with the lock held. Like time.Timer, C has room for a
+// single value that is dropped if nobody read the previous one.
+func (f *Fake) fire(t *fakeTimer) {
+	delete(f.timers, t)
+	select {
+	case t.ch <- f.now:
+	default:
+	}
+}
+
+// fakeTimer fires when its Fake clock is advanced past at
+type fakeTimer struct {
+	fake *Fake
+	at   time.Time
+	ch   chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Reset(at time.Time) {
+	t.fake.Lock()
+	defer t.fake.Unlock()
+	t.at = at
+	if !at.After(t.fake.now) {
+		t.fake.fire(t)
+		return
+	}
+	t.fake.timers[t] = struct{}{}
+	t.fake.cond.Broadcast()
+}
+
+func (t *fakeTimer) Stop() {
+	t.fake.Lock()
+	defer t.fake.Unlock()
+	delete(t.fake.timers, t)
+}
@@ -0,0 +1,95 @@
+package clock
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// WARNING: Don't use this, use testify instead!
+// https://github.com/stretchr/testify
+// This is only good if you are limited to std library
+// and know what you are doing...
+func equal(t *testing.T, want, have any) {
+	if want != have {
+		_, f, l, _ := runtime.Caller(1)
+		t.Errorf("\n%s:%d\n\t%s\texpected: %v - got: %v", f, l, t.Name(), want, have)
+	}
+}
+
+// fired tells if the timer sent a value, without blocking
+func fired(timer Timer) bool {
+	select {
+	case <-timer.C():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestFake(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFake(start)
+	equal(t, start, c.Now())
+	timer := c.NewTimer(start.Add(time.Second))
+	c.Advance(500 * time.Millisecond)
+	equal(t, false, fired(timer))
+	equal(t, 500*time.Millisecond, c.Since(start))
+	c.Advance(500 * time.Millisecond)
+	equal(t, true, fired(timer))
+	// Deadlines already reached fire right away
+	timer.Reset(start)
+	equal(t, true, fired(timer))
+	// Stopped timers never fire
+	timer.Reset(c.Now().Add(time.Second))
+	timer.Stop()
+	c.Advance(time.Hour)
+	equal(t, false, fired(timer))
+}
+
+// Timers are waited for, so the clock is advanced past their deadlines
+func TestBlockUntil(t *testing.T) {
+	c := NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	done := make(chan bool)
+	go func() {
+		timer := c.NewTimer(c.Now().Add(time.Second))
+		<-timer.C()
+		done <- true
+	}()
+	c.BlockUntil(1)
+	c.Advance(time.Second)
+	equal(t, true, <-done)
+}
+
+// Contexts expire once the clock reaches their deadline
+func TestWithTimeout(t *testing.T) {
+	c := NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	ctx, cancel := WithTimeout(context.Background(), c, time.Second)
+	defer cancel()
+	c.Advance(500 * time.Millisecond)
+	equal(t, nil, ctx.Err())
+	c.Advance(500 * time.Millisecond)
+	<-ctx.Done()
+	equal(t, context.Canceled, ctx.Err())
+	// Canceling releases the timer
+	ctx, cancel = WithTimeout(context.Background(), c, time.Second)
+	cancel()
+	equal(t, context.Canceled, ctx.Err())
+	equal(t, 0, len(c.timers))
+	// Real clocks work the same way
+	ctx, cancel = WithTimeout(context.Background(), Real{}, 0)
+	defer cancel()
+	<-ctx.Done()
+}
+
+func TestReal(t *testing.T) {
+	c := Real{}
+	start := c.Now()
+	timer := c.NewTimer(start)
+	<-timer.C()
+	equal(t, true, c.Since(start) >= 0)
+	timer.Reset(c.Now().Add(time.Hour))
+	timer.Stop()
+	equal(t, false, fired(timer))
+}
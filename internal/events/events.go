@@ -0,0 +1,143 @@
+/*
+Events package provides a very simple in-memory publish/subscribe broker
+for the write lifecycle of the hashes, so it can be streamed to clients.
+
+Every event gets a sequence number, and the last events are kept on a
+bounded ring buffer so subscribers can resume from the last event they
+saw (Server-Sent Events Last-Event-ID), older events are just lost.
+*/
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/phrozen/password-hash-exercise/internal/clock"
+)
+
+// Event is a single notification of the write lifecycle of an id
+type Event struct {
+	Seq  uint64
+	Type string
+	ID   int
+	Time time.Time
+}
+
+// Buffer size for every subscriber channel, subscribers that can't keep
+// up are dropped instead of blocking publishers (they can resume).
+const SUBSCRIBER_BUFFER = 64
+
+// Broker fans out published events to every subscriber
+type Broker struct {
+	sync.Mutex
+	clock       clock.Clock
+	seq         uint64
+	buffer      []Event
+	next        int
+	subscribers map[chan Event]struct{}
+	done        chan struct{}
+	closed      bool
+}
+
+// Option configures a Broker
+type Option func(*Broker)
+
+// WithClock replaces the real clock used to timestamp events
+func WithClock(c clock.Clock) Option {
+	return func(b *Broker) {
+		b.clock = c
+	}
+}
+
+// NewBroker creates a broker that keeps the last 'size' events
+func NewBroker(size int, options ...Option) *Broker {
+	b := &Broker{
+		clock:       clock.Real{},
+		buffer:      make([]Event, 0, size),
+		subscribers: make(map[chan Event]struct{}),
+		done:        make(chan struct{}),
+	}
+	for _, option := range options {
+		option(b)
+	}
+	return b
+}
+
+// Publish sends a new event to every subscriber, it never blocks
+// and events published after Close are discarded.
+func (b *Broker) Publish(kind string, id int) {
+	b.Lock()
+	defer b.Unlock()
+	if b.closed {
+		return
+	}
+	b.seq++
+	event := Event{Seq: b.seq, Type: kind, ID: id, Time: b.clock.Now()}
+	// Ring buffer, overwrite the oldest event once full
+	if len(b.buffer) < cap(b.buffer) {
+		b.buffer = append(b.buffer, event)
+	} else if cap(b.buffer) > 0 {
+		b.buffer[b.next] = event
+		b.next = (b.next + 1) % cap(b.buffer)
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// Slow subscriber, drop it
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns the buffered events after seq 'last' and a channel
+// for the new ones, which is closed when the subscriber is dropped or
+// the broker is closed. Call cancel once done to release it.
+func (b *Broker) Subscribe(last uint64) ([]Event, <-chan Event, func()) {
+	b.Lock()
+	defer b.Unlock()
+	backlog := []Event{}
+	// Oldest event is at next once the buffer is full
+	for i := 0; i < len(b.buffer); i++ {
+		event := b.buffer[(b.next+i)%len(b.buffer)]
+		if event.Seq > last {
+			backlog = append(backlog, event)
+		}
+	}
+	ch := make(chan Event, SUBSCRIBER_BUFFER)
+	if b.closed {
+		close(ch)
+		return backlog, ch, func() {}
+	}
+	b.subscribers[ch] = struct{}{}
+	cancel := func() {
+		b.Lock()
+		defer b.Unlock()
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+	return backlog, ch, cancel
+}
+
+// Done returns a channel that is closed when the broker is closed
+func (b *Broker) Done() <-chan struct{} {
+	return b.done
+}
+
+// Close ends every subscription, it is safe to call more than once
+func (b *Broker) Close() {
+	b.Lock()
+	defer b.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for ch := range b.subscribers {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+	close(b.done)
+}
@@ -0,0 +1,92 @@
+package events
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/phrozen/password-hash-exercise/internal/clock"
+)
+
+// WARNING: Don't use this, use testify instead!
+// https://github.com/stretchr/testify
+// This is only good if you are limited to std library
+// and know what you are doing...
+func equal(t *testing.T, want, have any) {
+	if want != have {
+		_, f, l, _ := runtime.Caller(1)
+		t.Errorf("\n%s:%d\n\t%s\texpected: %v - got: %v", f, l, t.Name(), want, have)
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := NewBroker(10, WithClock(clock.NewFake(now)))
+	defer b.Close()
+	backlog, ch, cancel := b.Subscribe(0)
+	defer cancel()
+	equal(t, 0, len(backlog))
+	b.Publish("accepted", 1)
+	b.Publish("persisted", 1)
+	event := <-ch
+	equal(t, uint64(1), event.Seq)
+	equal(t, "accepted", event.Type)
+	equal(t, 1, event.ID)
+	equal(t, now, event.Time)
+	event = <-ch
+	equal(t, uint64(2), event.Seq)
+	equal(t, "persisted", event.Type)
+}
+
+// Only the last 'size' events can be resumed
+func TestResume(t *testing.T) {
+	b := NewBroker(5)
+	defer b.Close()
+	for i := 1; i <= 8; i++ {
+		b.Publish("accepted", i)
+	}
+	backlog, _, cancel := b.Subscribe(0)
+	cancel()
+	equal(t, 5, len(backlog))
+	equal(t, uint64(4), backlog[0].Seq)
+	equal(t, uint64(8), backlog[4].Seq)
+	backlog, _, cancel = b.Subscribe(6)
+	cancel()
+	equal(t, 2, len(backlog))
+	equal(t, uint64(7), backlog[0].Seq)
+	// Cancel is safe to call twice
+	cancel()
+}
+
+// Slow subscribers are dropped instead of blocking
+func TestSlowSubscriber(t *testing.T) {
+	b := NewBroker(0)
+	defer b.Close()
+	_, ch, cancel := b.Subscribe(0)
+	defer cancel()
+	for i := 0; i <= SUBSCRIBER_BUFFER; i++ {
+		b.Publish("accepted", i)
+	}
+	count := 0
+	for range ch {
+		count++
+	}
+	equal(t, SUBSCRIBER_BUFFER, count)
+}
+
+func TestClose(t *testing.T) {
+	b := NewBroker(10)
+	_, ch, cancel := b.Subscribe(0)
+	defer cancel()
+	b.Close()
+	b.Close()
+	_, ok := <-ch
+	equal(t, false, ok)
+	<-b.Done()
+	// Nothing happens after close
+	b.Publish("accepted", 1)
+	backlog, ch, _ := b.Subscribe(0)
+	equal(t, 0, len(backlog))
+	_, ok = <-ch
+	equal(t, false, ok)
+}
@@ -0,0 +1,234 @@
+/*
+Metrics package provides a small subset of Prometheus metrics written in
+the text exposition format (version 0.0.4), without a third party client
+library: request counters and latency histograms collected by a
+middleware, gauges read on every scrape, and Go runtime metrics.
+
+https://prometheus.io/docs/instrumenting/exposition_formats/
+*/
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/phrozen/password-hash-exercise/internal/clock"
+	"github.com/phrozen/password-hash-exercise/internal/middleware/labels"
+	"github.com/phrozen/password-hash-exercise/internal/middleware/logger"
+)
+
+// Latency histogram buckets in seconds, same as Prometheus defaults
+var BUCKETS = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Content type of the text exposition format
+const CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// requestKey identifies a request counter
+type requestKey struct {
+	route  string
+	method string
+	code   int
+}
+
+// latencyKey identifies a latency histogram
+type latencyKey struct {
+	route  string
+	method string
+}
+
+// histogram keeps cumulative counts per bucket plus the +Inf bucket
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// gauge is read on every scrape
+type gauge struct {
+	name string
+	help string
+	read func() float64
+}
+
+// Metrics holds every metric exposed, safe for concurrent use
+type Metrics struct {
+	sync.Mutex
+	clock     clock.Clock
+	requests  map[requestKey]uint64
+	latencies map[latencyKey]*histogram
+	gauges    []gauge
+}
+
+// Option configures Metrics
+type Option func(*Metrics)
+
+// WithClock replaces the real clock used to measure requests
+func WithClock(c clock.Clock) Option {
+	return func(m *Metrics) {
+		m.clock = c
+	}
+}
+
+// New returns empty metrics with the real clock
+func New(options ...Option) *Metrics {
+	m := &Metrics{
+		clock:     clock.Real{},
+		requests:  make(map[requestKey]uint64),
+		latencies: make(map[latencyKey]*histogram),
+	}
+	for _, option := range options {
+		option(m)
+	}
+	return m
+}
+
+// Gauge registers a gauge that is read with fn on every scrape
+func (m *Metrics) Gauge(name, help string, fn func() float64) {
+	m.Lock()
+	defer m.Unlock()
+	m.gauges = append(m.gauges, gauge{name, help, fn})
+}
+
+// Observe records a request for route and method, with the response
+// status code and the time it took in seconds.
+func (m *Metrics) Observe(route, method string, code int, seconds float64) {
+	m.Lock()
+	defer m.Unlock()
+	m.requests[requestKey{route, method, code}]++
+	h, ok := m.latencies[latencyKey{route, method}]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(BUCKETS))}
+		m.latencies[latencyKey{route, method}] = h
+	}
+	for i, bound := range BUCKETS {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// Middleware observes every request to next, route is used to map
+// requests to a bounded set of route labels (e.g. "/hash/{id}") and
+// methods are mapped to a bounded set as well (see labels.Method), as
+// every label value is a new series.
+func (m *Metrics) Middleware(route func(*http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ro := logger.NewResponseObserver(w, m.clock)
+		next.ServeHTTP(ro, r)
+		m.Observe(route(r), labels.Method(r), ro.StatusCode(), ro.Elapsed().Seconds())
+	})
+}
+
+// Handler serves the metrics in the text exposition format
+func (m *Metrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", CONTENT_TYPE)
+		m.WriteTo(w)
+	})
+}
+
+// WriteTo writes all the metrics in the text exposition format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var sb strings.Builder
+	m.Lock()
+	m.writeRequests(&sb)
+	m.writeLatencies(&sb)
+	gauges := m.gauges
+	m.Unlock()
+	// Gauges are read outside the lock, they might take their own
+	for _, g := range gauges {
+		header(&sb, g.name, g.help, "gauge")
+		fmt.Fprintf(&sb, "%s %s\n", g.name, number(g.read()))
+	}
+	writeRuntime(&sb)
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+func (m *Metrics) writeRequests(sb *strings.Builder) {
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	// Deterministic output, sorted by labels
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	header(sb, "http_requests_total", "Total number of HTTP requests.", "counter")
+	for _, key := range keys {
+		fmt.Fprintf(sb, "http_requests_total{route=%q,method=%q,code=\"%d\"} %d\n",
+			key.route, key.method, key.code, m.requests[key])
+	}
+}
+
+func (m *Metrics) writeLatencies(sb *strings.Builder) {
+	keys := make([]latencyKey, 0, len(m.latencies))
+	for key := range m.latencies {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].method < keys[j].method
+	})
+	name := "http_request_duration_seconds"
+	header(sb, name, "HTTP request latencies in seconds.", "histogram")
+	for _, key := range keys {
+		h := m.latencies[key]
+		labels := fmt.Sprintf("route=%q,method=%q", key.route, key.method)
+		for i, bound := range BUCKETS {
+			fmt.Fprintf(sb, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, number(bound), h.counts[i])
+		}
+		fmt.Fprintf(sb, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+		fmt.Fprintf(sb, "%s_sum{%s} %s\n", name, labels, number(h.sum))
+		fmt.Fprintf(sb, "%s_count{%s} %d\n", name, labels, h.count)
+	}
+}
+
+// writeRuntime writes the most relevant Go runtime metrics
+func writeRuntime(sb *strings.Builder) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	header(sb, "go_info", "Information about the Go environment.", "gauge")
+	fmt.Fprintf(sb, "go_info{version=%q} 1\n", runtime.Version())
+	header(sb, "go_goroutines", "Number of goroutines that currently exist.", "gauge")
+	fmt.Fprintf(sb, "go_goroutines %d\n", runtime.NumGoroutine())
+	header(sb, "go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", "gauge")
+	fmt.Fprintf(sb, "go_memstats_alloc_bytes %d\n", stats.Alloc)
+	header(sb, "go_memstats_sys_bytes", "Number of bytes obtained from system.", "gauge")
+	fmt.Fprintf(sb, "go_memstats_sys_bytes %d\n", stats.Sys)
+	header(sb, "go_memstats_heap_objects", "Number of allocated objects.", "gauge")
+	fmt.Fprintf(sb, "go_memstats_heap_objects %d\n", stats.HeapObjects)
+	header(sb, "go_gc_cycles_total", "Number of completed GC cycles.", "counter")
+	fmt.Fprintf(sb, "go_gc_cycles_total %d\n", stats.NumGC)
+}
+
+// header writes the HELP and TYPE lines of a metric
+func header(sb *strings.Builder, name, help, kind string) {
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// number formats a float in the shortest representation
+func number(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
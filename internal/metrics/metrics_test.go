@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phrozen/password-hash-exercise/internal/clock"
+)
+
+// WARNING: Don't use this, use testify instead!
+// https://github.com/stretchr/testify
+// This is only good if you are limited to std library
+// and know what you are doing...
+func equal(t *testing.T, want, have any) {
+	if want != have {
+		_, f, l, _ := runtime.Caller(1)
+		t.Errorf("\n%s:%d\n\t%s\texpected: %v - got: %v", f, l, t.Name(), want, have)
+	}
+}
+
+// Helper to check a line is present in the exposition
+func contains(t *testing.T, output, line string) {
+	if !strings.Contains(output, line+"\n") {
+		_, f, l, _ := runtime.Caller(1)
+		t.Errorf("\n%s:%d\n\t%s\tmissing line: %s", f, l, t.Name(), line)
+	}
+}
+
+func TestObserve(t *testing.T) {
+	m := New()
+	m.Observe("/hash", "POST", 200, 0.003)
+	m.Observe("/hash", "POST", 200, 0.2)
+	m.Observe("/hash", "POST", 400, 20)
+	var sb strings.Builder
+	m.WriteTo(&sb)
+	output := sb.String()
+	contains(t, output, "# TYPE http_requests_total counter")
+	contains(t, output, `http_requests_total{route="/hash",method="POST",code="200"} 2`)
+	contains(t, output, `http_requests_total{route="/hash",method="POST",code="400"} 1`)
+	contains(t, output, "# TYPE http_request_duration_seconds histogram")
+	contains(t, output, `http_request_duration_seconds_bucket{route="/hash",method="POST",le="0.005"} 1`)
+	contains(t, output, `http_request_duration_seconds_bucket{route="/hash",method="POST",le="0.25"} 2`)
+	contains(t, output, `http_request_duration_seconds_bucket{route="/hash",method="POST",le="10"} 2`)
+	contains(t, output, `http_request_duration_seconds_bucket{route="/hash",method="POST",le="+Inf"} 3`)
+	contains(t, output, `http_request_duration_seconds_sum{route="/hash",method="POST"} 20.203`)
+	contains(t, output, `http_request_duration_seconds_count{route="/hash",method="POST"} 3`)
+	contains(t, output, "# TYPE go_goroutines gauge")
+}
+
+func TestGauge(t *testing.T) {
+	m := New()
+	m.Gauge("store_pending_writes", "Pending writes.", func() float64 { return 42 })
+	var sb strings.Builder
+	m.WriteTo(&sb)
+	contains(t, sb.String(), "# TYPE store_pending_writes gauge")
+	contains(t, sb.String(), "store_pending_writes 42")
+}
+
+// Middleware captures status codes through the response observer
+func TestMiddleware(t *testing.T) {
+	m := New()
+	handler := m.Middleware(func(r *http.Request) string { return "/route" },
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/route", nil))
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	equal(t, http.StatusOK, rec.Code)
+	equal(t, CONTENT_TYPE, rec.Header().Get("Content-Type"))
+	contains(t, rec.Body.String(), `http_requests_total{route="/route",method="GET",code="418"} 1`)
+
+	rec = httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+// Methods made up by clients share a single series, latencies
+// are measured with the given clock
+func TestMiddlewareLabels(t *testing.T) {
+	c := clock.NewFake(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	m := New(WithClock(c))
+	handler := m.Middleware(func(r *http.Request) string { return "/route" },
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c.Advance(20 * time.Millisecond)
+		}))
+	for _, method := range []string{"XA", "XAA", "XAAA", http.MethodDelete} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/route", nil))
+	}
+	var sb strings.Builder
+	m.WriteTo(&sb)
+	output := sb.String()
+	contains(t, output, `http_requests_total{route="/route",method="OTHER",code="200"} 3`)
+	contains(t, output, `http_requests_total{route="/route",method="DELETE",code="200"} 1`)
+	contains(t, output, `http_request_duration_seconds_bucket{route="/route",method="OTHER",le="0.01"} 0`)
+	contains(t, output, `http_request_duration_seconds_bucket{route="/route",method="OTHER",le="0.025"} 3`)
+	equal(t, false, strings.Contains(output, `method="XA"`))
+}
@@ -0,0 +1,20 @@
+/*
+Labels package provides the helpers shared by the middlewares that
+track requests (stats and metrics) to map them to a bounded set of
+labels, as values are chosen by clients and every new one is tracked
+on its own (e.g. a new series for metrics) for as long as it runs.
+*/
+package labels
+
+import "net/http"
+
+// Method returns the request method if it is a standard one or OTHER,
+// methods are case sensitive and any token is valid, so "get" is OTHER.
+func Method(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return r.Method
+	}
+	return "OTHER"
+}
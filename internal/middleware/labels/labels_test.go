@@ -0,0 +1,44 @@
+package labels
+
+import (
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+// WARNING: Don't use this, use testify instead!
+// https://github.com/stretchr/testify
+// This is only good if you are limited to std library
+// and know what you are doing...
+func equal(t *testing.T, want, have any) {
+	if want != have {
+		_, f, l, _ := runtime.Caller(1)
+		t.Errorf("\n%s:%d\n\t%s\texpected: %v - got: %v", f, l, t.Name(), want, have)
+	}
+}
+
+func TestMethod(t *testing.T) {
+	tests := []struct {
+		method string
+		want   string
+	}{
+		{"GET", "GET"},
+		{"HEAD", "HEAD"},
+		{"POST", "POST"},
+		{"PUT", "PUT"},
+		{"PATCH", "PATCH"},
+		{"DELETE", "DELETE"},
+		{"CONNECT", "CONNECT"},
+		{"OPTIONS", "OPTIONS"},
+		{"TRACE", "TRACE"},
+		// Unknown tokens, lowercase ones included (case sensitive)
+		{"PROPFIND", "OTHER"},
+		{"BREW", "OTHER"},
+		{"get", "OTHER"},
+		{"Post", "OTHER"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/hash", nil)
+		equal(t, test.want, Method(r))
+	}
+}
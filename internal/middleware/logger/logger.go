@@ -14,26 +14,52 @@ import (
 	"log"
 	"net/http"
 	"time"
+
+	"github.com/phrozen/password-hash-exercise/internal/clock"
 )
 
 // ResponseObserver embeds a ResponseWriter for logging purposes
 type ResponseObserver struct {
 	http.ResponseWriter
 	statusCode int
+	clock      clock.Clock
 	start      time.Time
 }
 
+// NewResponseObserver wraps w starting the clock for the response,
+// useful for other middlewares that need to track responses.
+func NewResponseObserver(w http.ResponseWriter, c clock.Clock) *ResponseObserver {
+	return &ResponseObserver{w, http.StatusOK, c, c.Now()}
+}
+
+// StatusCode returns the response status code, 200 by default
+func (ro *ResponseObserver) StatusCode() int {
+	return ro.statusCode
+}
+
+// Elapsed returns the time since the response observer was created
+func (ro *ResponseObserver) Elapsed() time.Duration {
+	return ro.clock.Since(ro.start)
+}
+
 // WriteHeader implementation to track status code from the response
 func (ro *ResponseObserver) WriteHeader(code int) {
 	ro.statusCode = code
 	ro.ResponseWriter.WriteHeader(code)
 }
 
-// Logger middleware for debugging purposes
-func Logger(next http.Handler) http.Handler {
+// Flush implementation to keep streaming responses working
+func (ro *ResponseObserver) Flush() {
+	if f, ok := ro.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Logger middleware for debugging purposes, elapsed times use c
+func Logger(next http.Handler, c clock.Clock) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ro := &ResponseObserver{w, http.StatusOK, time.Now()}
+		ro := NewResponseObserver(w, c)
 		next.ServeHTTP(ro, r)
-		log.Printf("[%d] %s %s %v", ro.statusCode, r.Method, r.URL.Path, time.Since(ro.start))
+		log.Printf("[%d] %s %s %v", ro.statusCode, r.Method, r.URL.Path, ro.Elapsed())
 	})
 }
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/phrozen/password-hash-exercise/internal/app"
+	"github.com/phrozen/password-hash-exercise/internal/store"
+)
+
+// Non standard status (nginx) for requests the client gave up on,
+// the response is never seen but it is logged and tracked on stats.
+const STATUS_CLIENT_CLOSED_REQUEST = 499
+
+// errorStatus maps errors from the application and the Store to HTTP
+// statuses, errors are wrapped across layers so errors.Is is used.
+// Anything unknown is an internal error.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, store.ErrPending):
+		// Exists but can't be used until the write is done
+		return http.StatusConflict
+	case errors.Is(err, app.ErrPasswordTooLong):
+		return http.StatusBadRequest
+	case errors.Is(err, app.ErrInvalidPHC), errors.Is(err, app.ErrUnknownKey):
+		// The stored hash is corrupt or peppered with a key this server
+		// is missing, nothing the client can fix with another request
+		return http.StatusInternalServerError
+	case errors.Is(err, store.ErrBackpressure), errors.Is(err, store.ErrClosed):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.Canceled):
+		return STATUS_CLIENT_CLOSED_REQUEST
+	}
+	return http.StatusInternalServerError
+}
+
+// statusText is http.StatusText aware of non standard statuses
+func statusText(code int) string {
+	if code == STATUS_CLIENT_CLOSED_REQUEST {
+		return "Client Closed Request"
+	}
+	return http.StatusText(code)
+}
+
+// writeFailure replies with the status mapped from err, letting the
+// client know when to come back if the error is temporary. Server
+// errors are logged and replied with a generic detail, as they may
+// carry internals (paths, store state) clients must not see.
+func writeFailure(w http.ResponseWriter, r *http.Request, err error) {
+	retryAfter(w, err)
+	status := errorStatus(err)
+	detail := err.Error()
+	if status >= http.StatusInternalServerError {
+		log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+		detail = statusText(status)
+	}
+	writeError(w, r, detail, status)
+}
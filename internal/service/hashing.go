@@ -1,51 +1,113 @@
 package service
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"regexp"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/phrozen/password-hash-exercise/internal/app"
+	"github.com/phrozen/password-hash-exercise/internal/clock"
+	"github.com/phrozen/password-hash-exercise/internal/events"
+	"github.com/phrozen/password-hash-exercise/internal/metrics"
 	"github.com/phrozen/password-hash-exercise/internal/middleware/logger"
 	"github.com/phrozen/password-hash-exercise/internal/stats"
 	"github.com/phrozen/password-hash-exercise/internal/store"
 )
 
+// Number of events kept to resume streams with Last-Event-ID
+const EVENTS_BUFFER = 1024
+
+// Upper limit for long polling on GET /hash/<id:int>?wait=<duration>
+const MAX_WAIT = 30 * time.Second
+
 var (
-	getHashRe = regexp.MustCompile(`^\/hash\/(\d+)$`)
-	setHashRe = regexp.MustCompile(`^\/hash[\/]*$`)
+	getHashRe    = regexp.MustCompile(`^\/hash\/(\d+)$`)
+	setHashRe    = regexp.MustCompile(`^\/hash[\/]*$`)
+	verifyHashRe = regexp.MustCompile(`^\/hash\/(\d+)\/verify$`)
 )
 
-// HashingService implements Service and provides all request handlers
+// HashingService implements Service and provides all request handlers,
+// its lifecycle goes from open to draining (Drain, server shutting down)
+// where new hashes are rejected, and then closed (Close).
 type HashingService struct {
+	sync.Mutex
 	application *app.App
 	logging     bool
 	quit        chan bool
 	router      *http.ServeMux
-	statistics  *stats.Stats
+	statistics  *stats.Routes
+	events      *events.Broker
+	metrics     *metrics.Metrics
+	clock       clock.Clock
+	state       store.Lifecycle
 }
 
-func NewHashingService(delay time.Duration, logging bool) *HashingService {
+// Option configures the HashingService
+type Option func(*HashingService)
+
+// WithClock replaces the real clock used for stats, metrics, logs,
+// event timestamps and long polling waits
+func WithClock(c clock.Clock) Option {
+	return func(s *HashingService) {
+		s.clock = c
+	}
+}
+
+// statsResponse keeps the original shape of /stats (POST /hash) at
+// the top level and adds other endpoints as nested objects, with a
+// breakdown of every route by outcome class (2xx, 4xx, 5xx).
+type statsResponse struct {
+	stats.Response
+	Verify   stats.Response                       `json:"verify"`
+	Rehashed int64                                `json:"rehashed"`
+	Pending  int                                  `json:"pending"`
+	Routes   map[string]map[string]stats.Response `json:"routes"`
+}
+
+// NewHashingService creates the service on top of the given application,
+// which owns the Store and will be closed along with the service.
+func NewHashingService(application *app.App, logging bool, options ...Option) *HashingService {
 	s := &HashingService{
-		application: app.New(store.NewMemory(delay)),
+		application: application,
 		logging:     logging,
 		quit:        make(chan bool),
 		router:      http.NewServeMux(),
-		statistics:  stats.New(),
+		clock:       clock.Real{},
+	}
+	for _, option := range options {
+		option(s)
 	}
+	s.events = events.NewBroker(EVENTS_BUFFER, events.WithClock(s.clock))
+	s.metrics = metrics.New(metrics.WithClock(s.clock))
+	s.statistics = stats.NewRoutes(stats.WithClock(s.clock))
+	s.application.Observe(s.events.Publish)
+	s.metrics.Gauge("store_hashes", "Number of hashes saved in the store.", func() float64 {
+		saved, _ := s.application.Size()
+		return float64(saved)
+	})
+	s.metrics.Gauge("store_pending_writes", "Number of hashes waiting to be written.", func() float64 {
+		_, pending := s.application.Size()
+		return float64(pending)
+	})
 	s.setup()
 	return s
 }
 
-// Handler will return the service http handler wrapped
-// around with a logger middleware based on configuration
+// Handler will return the service http handler wrapped around with
+// the stats and metrics middlewares and a logger based on configuration
 func (s *HashingService) Handler() http.Handler {
+	handler := s.statistics.Middleware(route, s.router)
+	handler = s.metrics.Middleware(route, handler)
 	if s.logging {
-		return logger.Logger(s.router)
+		return logger.Logger(handler, s.clock)
 	}
-	return s.router
+	return handler
 }
 
 // Shutdown returns the service's shutdown signaling channel
@@ -53,10 +115,27 @@ func (s *HashingService) Shutdown() chan bool {
 	return s.quit
 }
 
-// Close performs teardown operations for the service
+// Drain ends all the event streams, so the server does not have
+// to wait on them (long lived connections) during graceful shutdown,
+// and rejects new hashes while the requests in flight are finished.
+func (s *HashingService) Drain() {
+	s.state.Drain()
+	s.application.Drain()
+	s.events.Close()
+}
+
+// Close performs teardown operations for the service, it is safe
+// to call it many times, only the first one closes the quit channel.
 func (s *HashingService) Close() error {
-	close(s.quit)
-	return s.application.Close()
+	s.Drain()
+	err := s.application.Close()
+	// Shutdown requests send on quit under the same lock
+	s.Lock()
+	if s.state.Close() {
+		close(s.quit)
+	}
+	s.Unlock()
+	return err
 }
 
 // Setup routes and handlers for the service
@@ -67,34 +146,50 @@ func (s *HashingService) setup() {
 	s.router.HandleFunc("/hash", s.hashHandler)
 	s.router.HandleFunc("/hash/", s.hashHandler)
 	s.router.HandleFunc("/stats", s.statsHandler)
+	s.router.HandleFunc("/events", s.eventsHandler)
+	s.router.Handle("/metrics", s.metrics.Handler())
 	s.router.HandleFunc("/shutdown", s.shutdownHandler)
 }
 
+// Maps a request to its route, used as label for metrics so ids
+// don't create a new series for every hash (bounded cardinality)
+func route(r *http.Request) string {
+	switch path := r.URL.Path; {
+	case getHashRe.MatchString(path):
+		return "/hash/{id}"
+	case verifyHashRe.MatchString(path):
+		return "/hash/{id}/verify"
+	case setHashRe.MatchString(path):
+		return "/hash"
+	case path == "/stats", path == "/events", path == "/metrics", path == "/shutdown":
+		return path
+	}
+	return "other"
+}
+
 func (s *HashingService) hashHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		// GET /hash/<id:int>
 		if !getHashRe.MatchString(r.URL.Path) {
-			http.Error(w, "GET /hash/<id:int>", http.StatusBadRequest)
+			writeError(w, r, "GET /hash/<id:int>", http.StatusBadRequest)
 			return
 		}
 		s.getHash(w, r)
 	case http.MethodPost:
+		// POST /hash/<id:int>/verify Form(password:<string>)
+		if verifyHashRe.MatchString(r.URL.Path) {
+			s.verifyHash(w, r)
+			return
+		}
 		//POST /hash Form(password:<string>)
 		if !setHashRe.MatchString(r.URL.Path) {
-			http.Error(w, "POST /hash Form(password=<string>)", http.StatusBadRequest)
+			writeError(w, r, "POST /hash Form(password=<string>)", http.StatusBadRequest)
 			return
 		}
-		// Calculate statistics of time to process POST requests
-		// Requirements are ambiguous, what does "process" mean in this context
-		// Does delay account in process time? only successful requests?
-		// Checking all requests to POST /hash for statistics to avoid tight coupling
-		// It might be a better idea to move it to application layer if requirements change
-		start := time.Now()
 		s.postHash(w, r)
-		s.statistics.Add(start)
 	default:
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 	}
 }
 
@@ -103,70 +198,251 @@ func (s *HashingService) getHash(w http.ResponseWriter, r *http.Request) {
 	matches := getHashRe.FindStringSubmatch(r.URL.Path)
 	if len(matches) < 2 {
 		// Should never fail due to regexp matching
-		http.Error(w, "GET /hash/<id:int>", http.StatusBadRequest)
+		writeError(w, r, "GET /hash/<id:int>", http.StatusBadRequest)
 		return
 	}
 	id, err := strconv.Atoi(matches[1])
 	if err != nil {
 		// Should never fail due to regexp matching
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
-	// Only error that can be returned is "Not Found"
-	hash, err := s.application.GetHash(id)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
-		return
+	// Optional long polling until the write is done, the wait is
+	// cut short if the client disconnects (request context).
+	wait := time.Duration(0)
+	if value := r.URL.Query().Get("wait"); value != "" {
+		if wait, err = time.ParseDuration(value); err != nil || wait < 0 {
+			writeError(w, r, "GET /hash/<id:int>?wait=<duration>", http.StatusBadRequest)
+			return
+		}
+		if wait > MAX_WAIT {
+			wait = MAX_WAIT
+		}
+	}
+	var hash string
+	if wait > 0 {
+		ctx, cancel := clock.WithTimeout(r.Context(), s.clock, wait)
+		defer cancel()
+		hash, err = s.application.WaitHash(ctx, id)
+	} else {
+		// Plain reads don't need a timer
+		hash, err = s.application.GetHash(r.Context(), id)
+	}
+	switch {
+	case errors.Is(err, store.ErrPending):
+		// Id was issued, let the client know when to come back
+		retryAfter(w, err)
+		if wantsJSON(r) {
+			writeJSON(w, http.StatusAccepted, hashResponse{ID: id, Status: STATUS_PENDING})
+			return
+		}
+		http.Error(w, store.ErrPending.Error(), http.StatusAccepted)
+	case err != nil:
+		writeFailure(w, r, err)
+	case wantsJSON(r):
+		// Stored hashes are always valid, the algorithm is just informative
+		phc, _ := app.ParsePHC(hash)
+		writeJSON(w, http.StatusOK, hashResponse{
+			ID:        id,
+			Status:    STATUS_PERSISTED,
+			Hash:      hash,
+			Algorithm: phc.ID,
+		})
+	default:
+		w.Write([]byte(hash))
 	}
-	w.Write([]byte(hash))
 }
 
 func (s *HashingService) postHash(w http.ResponseWriter, r *http.Request) {
-	password := r.FormValue("password")
-	if password == "" {
-		http.Error(w, "POST /hash Form(password=<string>)", http.StatusBadRequest)
+	password, err := readPassword(w, r)
+	if err != nil || password == "" {
+		writeError(w, r, "POST /hash Form(password=<string>) or JSON {\"password\":<string>}", http.StatusBadRequest)
 		return
 	}
-	id, err := s.application.SetHash(password)
+	created := s.clock.Now().UTC()
+	id, err := s.application.SetHash(r.Context(), password)
 	if err != nil {
-		// Never fails with memory store
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		// Too many pending writes (503) comes with Retry-After
+		writeFailure(w, r, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/hash/%d", id))
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, hashResponse{ID: id, Status: STATUS_PENDING, CreatedAt: &created})
 		return
 	}
 	fmt.Fprintf(w, "%d", id)
 }
 
+func (s *HashingService) verifyHash(w http.ResponseWriter, r *http.Request) {
+	// Regular expression matching should prevent this from ever failing
+	id, err := strconv.Atoi(verifyHashRe.FindStringSubmatch(r.URL.Path)[1])
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	password, err := readPassword(w, r)
+	if err != nil || password == "" {
+		writeError(w, r, "POST /hash/<id:int>/verify Form(password=<string>) or JSON {\"password\":<string>}", http.StatusBadRequest)
+		return
+	}
+	result, err := s.application.Verify(r.Context(), id, password)
+	if result.Rehashed {
+		// Let clients know the hash was upgraded to current settings
+		w.Header().Set("X-Hash-Rehashed", "true")
+	}
+	switch {
+	case err != nil:
+		// Pending hashes can't be checked until the write is done (409)
+		writeFailure(w, r, err)
+	case wantsJSON(r):
+		writeJSON(w, http.StatusOK, verifyResponse{ID: id, Match: result.Match, Rehashed: result.Rehashed})
+	case result.Match:
+		w.Write([]byte("match"))
+	default:
+		w.Write([]byte("mismatch"))
+	}
+}
+
 func (s *HashingService) statsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
-	data, err := s.statistics.JSON()
+	// Statistics are tracked by the stats middleware for every route,
+	// the top level keeps the original requirement: time to process
+	// all POST /hash requests (any outcome) as it is not ambiguous.
+	_, pending := s.application.Size()
+	response := statsResponse{
+		Response: s.statistics.Get("/hash", http.MethodPost, stats.ALL).Snapshot(),
+		Verify:   s.statistics.Get("/hash/{id}/verify", http.MethodPost, stats.ALL).Snapshot(),
+		Rehashed: s.application.Rehashed(),
+		Pending:  pending,
+		Routes:   s.statistics.Snapshot(),
+	}
+	// Optional single rolling window GET /stats?window=<1m|5m|15m>
+	if name := r.URL.Query().Get("window"); name != "" {
+		if !response.Select(name) || !response.Verify.Select(name) {
+			writeError(w, r, "GET /stats?window=<1m|5m|15m>", http.StatusBadRequest)
+			return
+		}
+		for _, classes := range response.Routes {
+			for class, snapshot := range classes {
+				snapshot.Select(name)
+				classes[class] = snapshot
+			}
+		}
+	}
+	data, err := json.Marshal(response)
 	if err != nil {
 		// Should never fail
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(data)
 }
 
+// Streams the write lifecycle events as Server-Sent Events, clients can
+// resume a stream by sending the last event id they received.
+func (s *HashingService) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		// Should never fail with net/http response writers
+		writeError(w, r, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	last := uint64(0)
+	if value := r.Header.Get("Last-Event-ID"); value != "" {
+		var err error
+		if last, err = strconv.ParseUint(value, 10, 64); err != nil {
+			writeError(w, r, "Last-Event-ID: <id:uint>", http.StatusBadRequest)
+			return
+		}
+	}
+	backlog, stream, cancel := s.events.Subscribe(last)
+	defer cancel()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, event := range backlog {
+		writeEvent(w, event)
+	}
+	flusher.Flush()
+	for {
+		select {
+		case event, ok := <-stream:
+			// Dropped for being too slow or closed broker
+			if !ok {
+				return
+			}
+			writeEvent(w, event)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Writes a single event in the Server-Sent Events wire format
+func writeEvent(w http.ResponseWriter, event events.Event) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: {\"id\":%d,\"time\":\"%s\"}\n\n",
+		event.Seq, event.Type, event.ID, event.Time.UTC().Format(time.RFC3339Nano))
+}
+
+// Sets the Retry-After header (in seconds, rounded up) from the remaining
+// time of a pending write or until there is room for a new one (store
+// backpressure), the header must be set before WriteHeader.
+func retryAfter(w http.ResponseWriter, err error) {
+	var remaining time.Duration
+	var pending *store.PendingError
+	var full *store.BackpressureError
+	switch {
+	case errors.As(err, &pending):
+		remaining = pending.Remaining
+	case errors.As(err, &full):
+		remaining = full.RetryAfter
+	default:
+		return
+	}
+	seconds := int64(math.Ceil(remaining.Seconds()))
+	// Overdue writes should be done any moment now
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+}
+
 // Sends the shutdown signal to the quit channel, in this case to the HTTP Server
 // to beging the graceful shutdown process.
 func (s *HashingService) shutdownHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
 	// We write inside a select clause to the unbuffered channel quit, so on subsecuent
 	// requests we don't block the operation (channel write with no reader) and return
 	// an error instead. Most likely the server will stop incoming connections before
-	// that ever happens.
+	// that ever happens. The lock keeps Close from closing quit while sending.
+	s.Lock()
+	defer s.Unlock()
+	if s.state.State() != store.STATE_OPEN {
+		writeError(w, r, "Shutdown in progress...", http.StatusConflict)
+		return
+	}
 	select {
 	case s.quit <- true:
+		if wantsJSON(r) {
+			writeJSON(w, http.StatusOK, statusResponse{Status: "Shutting down the server."})
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("Shutting down the server."))
 	default:
-		http.Error(w, "Shutdown in progress...", http.StatusConflict)
+		writeError(w, r, "Shutdown in progress...", http.StatusConflict)
 	}
 }
@@ -1,17 +1,25 @@
 package service
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/phrozen/password-hash-exercise/internal/app"
+	"github.com/phrozen/password-hash-exercise/internal/clock"
 	"github.com/phrozen/password-hash-exercise/internal/stats"
+	"github.com/phrozen/password-hash-exercise/internal/store"
 )
 
 // WARNING: Don't use this, use testify instead!
@@ -28,6 +36,16 @@ func equal(t *testing.T, want, have any) {
 // Function alias to improve readability
 var request = httptest.NewRequest
 
+// Helper function to create a service with an instant memory store
+func newService() *HashingService {
+	return NewHashingService(app.New(store.NewMemory(0)), false)
+}
+
+// Fake clock for deterministic delays, it only moves with Advance
+func fake() *clock.Fake {
+	return clock.NewFake(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+}
+
 // Helper function to avoid code duplication and improve readability
 func serve(svc Service, req *http.Request) *httptest.ResponseRecorder {
 	rec := httptest.NewRecorder()
@@ -36,7 +54,7 @@ func serve(svc Service, req *http.Request) *httptest.ResponseRecorder {
 }
 
 func TestSuccess(t *testing.T) {
-	s := NewHashingService(0, false)
+	s := newService()
 	defer s.Close()
 	// Decide on a number of rounds for the test
 	rounds := 100
@@ -48,14 +66,19 @@ func TestSuccess(t *testing.T) {
 		res := serve(s, req)
 		equal(t, http.StatusOK, res.Result().StatusCode)
 		equal(t, fmt.Sprintf("%d", i), res.Body.String())
+		equal(t, fmt.Sprintf("/hash/%d", i), res.Result().Header.Get("Location"))
 	}
 	// Make sure all pending writes are done
-	time.Sleep(25 * time.Millisecond)
+	for i := 1; i <= rounds; i++ {
+		s.application.WaitHash(context.Background(), i)
+	}
 	// Test for GET success on the same index
 	for i := 1; i <= rounds; i++ {
 		res := serve(s, request(http.MethodGet, fmt.Sprintf("/hash/%d", i), nil))
 		equal(t, http.StatusOK, res.Result().StatusCode)
-		equal(t, app.HASH_LENGTH, len(res.Body.String()))
+		hash, err := app.ParsePHC(res.Body.String())
+		equal(t, nil, err)
+		equal(t, "sha512", hash.ID)
 	}
 	// Check stats
 	res := serve(s, request(http.MethodGet, "/stats", nil))
@@ -64,10 +87,421 @@ func TestSuccess(t *testing.T) {
 	err := json.Unmarshal(res.Body.Bytes(), &response)
 	equal(t, nil, err)
 	equal(t, rounds, int(response.Total))
+	equal(t, rounds, int(response.Windows["1m"].Total))
+	// Single rolling window
+	res = serve(s, request(http.MethodGet, "/stats?window=5m", nil))
+	equal(t, http.StatusOK, res.Result().StatusCode)
+	response = stats.Response{}
+	json.Unmarshal(res.Body.Bytes(), &response)
+	equal(t, 1, len(response.Windows))
+	equal(t, rounds, int(response.Windows["5m"].Total))
+	res = serve(s, request(http.MethodGet, "/stats?window=1h", nil))
+	equal(t, http.StatusBadRequest, res.Result().StatusCode)
+}
+
+func TestVerify(t *testing.T) {
+	s := newService()
+	defer s.Close()
+	// Helper for verify requests
+	verify := func(path, body string) *httptest.ResponseRecorder {
+		req := request(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		return serve(s, req)
+	}
+	res := verify("/hash", "password=secret")
+	equal(t, http.StatusOK, res.Result().StatusCode)
+	// Make sure the write is done
+	s.application.WaitHash(context.Background(), 1)
+	res = verify("/hash/1/verify", "password=secret")
+	equal(t, http.StatusOK, res.Result().StatusCode)
+	equal(t, "match", res.Body.String())
+	res = verify("/hash/1/verify", "password=Secret")
+	equal(t, http.StatusOK, res.Result().StatusCode)
+	equal(t, "mismatch", res.Body.String())
+	res = verify("/hash/2/verify", "password=secret")
+	equal(t, http.StatusNotFound, res.Result().StatusCode)
+	res = verify("/hash/1/verify", "password=")
+	equal(t, http.StatusBadRequest, res.Result().StatusCode)
+	// Pending writes can't be verified yet
+	c := fake()
+	pending := NewHashingService(app.New(store.NewMemory(time.Second, store.WithClock(c))), false, WithClock(c))
+	defer pending.Close()
+	defer c.Advance(time.Second)
+	req := request(http.MethodPost, "/hash", strings.NewReader("password=secret"))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	serve(pending, req)
+	req = request(http.MethodPost, "/hash/1/verify", strings.NewReader("password=secret"))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	res = serve(pending, req)
+	equal(t, http.StatusConflict, res.Result().StatusCode)
+	equal(t, "1", res.Result().Header.Get("Retry-After"))
+	// Verify has its own stats bucket
+	res = serve(s, request(http.MethodGet, "/stats", nil))
+	response := statsResponse{}
+	err := json.Unmarshal(res.Body.Bytes(), &response)
+	equal(t, nil, err)
+	equal(t, 1, int(response.Total))
+	equal(t, 4, int(response.Verify.Total))
+	equal(t, 0, int(response.Rehashed))
+	// Every route is broken down by outcome class
+	verifyRoute := response.Routes["POST /hash/{id}/verify"]
+	equal(t, 2, int(verifyRoute["2xx"].Total))
+	equal(t, 2, int(verifyRoute["4xx"].Total))
+	equal(t, 4, int(verifyRoute[stats.ALL].Total))
+}
+
+func TestVerifyRehash(t *testing.T) {
+	memory := store.NewMemory(0)
+	// Legacy SHA512 digest saved by previous versions
+	memory.Set(context.Background(), []byte("sQnzu7wkTrgkQZF+0G1hi5AI3Qmzvv0bXgc5THBqi7mAsdd4Xll27ASbRt9fEyavWi6m0QP9B8lThf+rDKy8hg=="))
+	s := NewHashingService(app.New(memory), false)
+	defer s.Close()
+	memory.Wait(context.Background(), 1)
+	req := request(http.MethodPost, "/hash/1/verify", strings.NewReader("password=password"))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	res := serve(s, req)
+	equal(t, http.StatusOK, res.Result().StatusCode)
+	equal(t, "match", res.Body.String())
+	equal(t, "true", res.Result().Header.Get("X-Hash-Rehashed"))
+	res = serve(s, request(http.MethodGet, "/stats", nil))
+	response := statsResponse{}
+	json.Unmarshal(res.Body.Bytes(), &response)
+	equal(t, 1, int(response.Rehashed))
+}
+
+// Requests from disconnected clients are not processed
+func TestCancel(t *testing.T) {
+	s := NewHashingService(app.New(store.NewMemory(0)), false)
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := request(http.MethodPost, "/hash", strings.NewReader("password=secret")).WithContext(ctx)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	res := serve(s, req)
+	equal(t, STATUS_CLIENT_CLOSED_REQUEST, res.Result().StatusCode)
+	saved, pending := s.application.Size()
+	equal(t, 0, saved+pending)
+}
+
+// Errors are mapped by kind, even when wrapped by other layers
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{store.ErrNotFound, http.StatusNotFound},
+		{&store.PendingError{ID: 1}, http.StatusConflict},
+		{&store.BackpressureError{Max: 1}, http.StatusServiceUnavailable},
+		{fmt.Errorf("set: %w", store.ErrBackpressure), http.StatusServiceUnavailable},
+		{fmt.Errorf("set: %w", store.ErrFull), http.StatusServiceUnavailable},
+		{fmt.Errorf("set: %w", store.ErrClosed), http.StatusServiceUnavailable},
+		{context.DeadlineExceeded, http.StatusServiceUnavailable},
+		{fmt.Errorf("get: %w", context.Canceled), STATUS_CLIENT_CLOSED_REQUEST},
+		{app.ErrInvalidPHC, http.StatusInternalServerError},
+		{fmt.Errorf("%w: k1", app.ErrUnknownKey), http.StatusInternalServerError},
+		{app.ErrPasswordTooLong, http.StatusBadRequest},
+		{errors.New("disk on fire"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		equal(t, test.want, errorStatus(test.err))
+	}
+	equal(t, "Client Closed Request", statusText(STATUS_CLIENT_CLOSED_REQUEST))
+}
+
+// Server errors don't leak their details, client errors explain themselves
+func TestFailureDetail(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeFailure(rec, request(http.MethodGet, "/hash/1", nil), errors.New("open /var/data/store: disk on fire"))
+	equal(t, http.StatusInternalServerError, rec.Code)
+	equal(t, false, strings.Contains(rec.Body.String(), "disk on fire"))
+	equal(t, "Internal Server Error\n", rec.Body.String())
+
+	c := fake()
+	s := NewHashingService(app.New(store.NewMemory(0, store.WithClock(c)), app.WithHasher(app.Bcrypt{Cost: 4})), false, WithClock(c))
+	defer s.Close()
+	req := request(http.MethodPost, "/hash", strings.NewReader("password="+strings.Repeat("a", 73)))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	res := serve(s, req)
+	equal(t, http.StatusBadRequest, res.Code)
+	equal(t, true, strings.Contains(res.Body.String(), app.ErrPasswordTooLong.Error()))
+}
+
+// Issued ids whose write is still pending are told apart from unknown ids
+func TestPending(t *testing.T) {
+	c := fake()
+	s := NewHashingService(app.New(store.NewMemory(2500*time.Millisecond, store.WithClock(c))), false, WithClock(c))
+	defer s.Close()
+	defer c.Advance(time.Hour)
+	req := request(http.MethodPost, "/hash", strings.NewReader("password=secret"))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	serve(s, req)
+	res := serve(s, request(http.MethodGet, "/hash/1", nil))
+	equal(t, http.StatusAccepted, res.Result().StatusCode)
+	// Remaining delay is rounded up to seconds
+	equal(t, "3", res.Result().Header.Get("Retry-After"))
+	c.Advance(time.Second)
+	res = serve(s, request(http.MethodGet, "/hash/1", nil))
+	equal(t, "2", res.Result().Header.Get("Retry-After"))
+	res = serve(s, request(http.MethodGet, "/hash/2", nil))
+	equal(t, http.StatusNotFound, res.Result().StatusCode)
+	equal(t, "", res.Result().Header.Get("Retry-After"))
+}
+
+// Writes past the maximum pending are rejected until there is room
+func TestBackpressure(t *testing.T) {
+	c := fake()
+	memory := store.NewMemory(1500*time.Millisecond, store.WithBackpressure(1, 0), store.WithClock(c))
+	s := NewHashingService(app.New(memory), false, WithClock(c))
+	defer s.Close()
+	// Cancelable contexts like the ones net/http gives to handlers,
+	// requests past the limit must not wait for room on them
+	post := func() *httptest.ResponseRecorder {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		req := request(http.MethodPost, "/hash", strings.NewReader("password=secret")).WithContext(ctx)
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		return serve(s, req)
+	}
+	equal(t, http.StatusOK, post().Result().StatusCode)
+	res := post()
+	equal(t, http.StatusServiceUnavailable, res.Result().StatusCode)
+	equal(t, "2", res.Result().Header.Get("Retry-After"))
+	// Pending depth is reported on stats
+	res = serve(s, request(http.MethodGet, "/stats", nil))
+	response := statsResponse{}
+	json.Unmarshal(res.Body.Bytes(), &response)
+	equal(t, 1, response.Pending)
+	equal(t, 1, int(response.Routes["POST /hash"]["5xx"].Total))
+	// Room is made once the write is done
+	c.Advance(1500 * time.Millisecond)
+	memory.Wait(context.Background(), 1)
+	equal(t, http.StatusOK, post().Result().StatusCode)
+	c.Advance(1500 * time.Millisecond)
+}
+
+// Long polling blocks until the write is done, the wait expires
+// or the client disconnects
+func TestLongPoll(t *testing.T) {
+	c := fake()
+	s := NewHashingService(app.New(store.NewMemory(100*time.Millisecond, store.WithClock(c))), false, WithClock(c))
+	defer s.Close()
+	req := request(http.MethodPost, "/hash", strings.NewReader("password=secret"))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	serve(s, req)
+	// The write is waiting on the clock
+	c.BlockUntil(1)
+	// Long polls on a go routine, returns once it is waiting on the clock too
+	poll := func(target string) <-chan *httptest.ResponseRecorder {
+		done := make(chan *httptest.ResponseRecorder)
+		go func() {
+			done <- serve(s, request(http.MethodGet, target, nil))
+		}()
+		c.BlockUntil(2)
+		return done
+	}
+	// Wait expires before the write
+	done := poll("/hash/1?wait=10ms")
+	c.Advance(10 * time.Millisecond)
+	res := <-done
+	equal(t, http.StatusAccepted, res.Result().StatusCode)
+	// Client disconnects
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res = serve(s, request(http.MethodGet, "/hash/1?wait=10s", nil).WithContext(ctx))
+	equal(t, http.StatusAccepted, res.Result().StatusCode)
+	// Write lands while waiting
+	done = poll("/hash/1?wait=10s")
+	c.Advance(90 * time.Millisecond)
+	res = <-done
+	equal(t, http.StatusOK, res.Result().StatusCode)
+	_, err := app.ParsePHC(res.Body.String())
+	equal(t, nil, err)
+	// Unknown ids don't wait at all
+	res = serve(s, request(http.MethodGet, "/hash/2?wait=10s", nil))
+	equal(t, http.StatusNotFound, res.Result().StatusCode)
+	for _, wait := range []string{"abc", "-1s", "10"} {
+		res = serve(s, request(http.MethodGet, "/hash/1?wait="+wait, nil))
+		equal(t, http.StatusBadRequest, res.Result().StatusCode)
+	}
+}
+
+// Reads the next Server-Sent Event as "<id> <event> <data>"
+func readEvent(t *testing.T, reader *bufio.Reader) string {
+	fields := []string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			return strings.Join(fields, " ")
+		}
+		_, value, _ := strings.Cut(line, ": ")
+		fields = append(fields, value)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	c := fake()
+	s := NewHashingService(app.New(store.NewMemory(50*time.Millisecond, store.WithClock(c))), false, WithClock(c))
+	server := httptest.NewServer(s.Handler())
+	defer server.Close()
+	res, err := http.Get(server.URL + "/events")
+	equal(t, nil, err)
+	defer res.Body.Close()
+	equal(t, http.StatusOK, res.StatusCode)
+	equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	reader := bufio.NewReader(res.Body)
+
+	http.PostForm(server.URL+"/hash", url.Values{"password": {"secret"}})
+	equal(t, `1 accepted {"id":1,"time":"2022-01-01T00:00:00Z"}`, readEvent(t, reader))
+	c.Advance(50 * time.Millisecond)
+	persisted := readEvent(t, reader)
+	equal(t, `2 persisted {"id":1,"time":"2022-01-01T00:00:00.05Z"}`, persisted)
+
+	// Resume from the first event
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/events", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resumed, err := http.DefaultClient.Do(req)
+	equal(t, nil, err)
+	defer resumed.Body.Close()
+	equal(t, persisted, readEvent(t, bufio.NewReader(resumed.Body)))
+
+	// Streams end on Close
+	s.Close()
+	_, err = reader.ReadString('\n')
+	equal(t, io.EOF, err)
+
+	req.Header.Set("Last-Event-ID", "abc")
+	res, err = http.DefaultClient.Do(req)
+	equal(t, nil, err)
+	equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+// JSON clients get structured responses and problem details
+func TestJSON(t *testing.T) {
+	c := fake()
+	s := NewHashingService(app.New(store.NewMemory(50*time.Millisecond, store.WithClock(c))), false, WithClock(c))
+	defer s.Close()
+	// Helper for JSON requests
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req := request(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "text/html, application/json;q=0.9")
+		return serve(s, req)
+	}
+	res := send(http.MethodPost, "/hash", `{"password":"secret"}`)
+	equal(t, http.StatusOK, res.Result().StatusCode)
+	equal(t, "application/json", res.Result().Header.Get("Content-Type"))
+	hash := hashResponse{}
+	equal(t, nil, json.Unmarshal(res.Body.Bytes(), &hash))
+	equal(t, 1, hash.ID)
+	equal(t, STATUS_PENDING, hash.Status)
+	equal(t, true, hash.CreatedAt != nil && hash.CreatedAt.Equal(c.Now()))
+
+	res = send(http.MethodGet, "/hash/1", "")
+	equal(t, http.StatusAccepted, res.Result().StatusCode)
+	hash = hashResponse{}
+	equal(t, nil, json.Unmarshal(res.Body.Bytes(), &hash))
+	equal(t, STATUS_PENDING, hash.Status)
+
+	// Long polling returns as soon as the write is done
+	c.Advance(50 * time.Millisecond)
+	res = send(http.MethodGet, "/hash/1?wait=1s", "")
+	equal(t, http.StatusOK, res.Result().StatusCode)
+	hash = hashResponse{}
+	equal(t, nil, json.Unmarshal(res.Body.Bytes(), &hash))
+	equal(t, STATUS_PERSISTED, hash.Status)
+	equal(t, "sha512", hash.Algorithm)
+	_, err := app.ParsePHC(hash.Hash)
+	equal(t, nil, err)
+
+	res = send(http.MethodPost, "/hash/1/verify", `{"password":"secret"}`)
+	equal(t, http.StatusOK, res.Result().StatusCode)
+	verify := verifyResponse{}
+	equal(t, nil, json.Unmarshal(res.Body.Bytes(), &verify))
+	equal(t, verifyResponse{ID: 1, Match: true}, verify)
+
+	// Errors are problem details
+	cases := map[string]int{
+		`{"password":""}`: http.StatusBadRequest,
+		`{"password":`:    http.StatusBadRequest,
+		`["secret"]`:      http.StatusBadRequest,
+	}
+	for body, status := range cases {
+		res = send(http.MethodPost, "/hash", body)
+		equal(t, status, res.Result().StatusCode)
+		equal(t, "application/problem+json", res.Result().Header.Get("Content-Type"))
+	}
+	res = send(http.MethodGet, "/hash/2", "")
+	equal(t, http.StatusNotFound, res.Result().StatusCode)
+	details := problem{}
+	equal(t, nil, json.Unmarshal(res.Body.Bytes(), &details))
+	equal(t, problem{
+		Type:     "about:blank",
+		Title:    "Not Found",
+		Status:   http.StatusNotFound,
+		Detail:   store.ErrNotFound.Error(),
+		Instance: "/hash/2",
+	}, details)
+
+	// Plain text is still the default, if JSON is not acceptable,
+	// or if the client prefers it (weights are compared)
+	for _, accept := range []string{
+		"*/*",
+		"application/json;q=0, text/plain",
+		"text/plain, application/json;q=0.1",
+		"application/*;q=0.5, text/*;q=0.5",
+	} {
+		req := request(http.MethodGet, "/hash/2", nil)
+		req.Header.Set("Accept", accept)
+		res = serve(s, req)
+		equal(t, "text/plain; charset=utf-8", res.Result().Header.Get("Content-Type"))
+	}
+	req := request(http.MethodGet, "/hash/2", nil)
+	req.Header.Set("Accept", "text/plain;q=0.5, application/json")
+	res = serve(s, req)
+	equal(t, "application/problem+json", res.Result().Header.Get("Content-Type"))
+
+	// Bodies are capped, as forms are
+	body := `{"password":"` + strings.Repeat("a", MAX_BODY_SIZE) + `"}`
+	res = send(http.MethodPost, "/hash", body)
+	equal(t, http.StatusBadRequest, res.Result().StatusCode)
+	saved, pending := s.application.Size()
+	equal(t, 1, saved+pending)
+}
+
+func TestMetrics(t *testing.T) {
+	c := fake()
+	s := NewHashingService(app.New(store.NewMemory(time.Second, store.WithClock(c))), false, WithClock(c))
+	defer s.Close()
+	defer c.Advance(time.Second)
+	req := request(http.MethodPost, "/hash", strings.NewReader("password=secret"))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	serve(s, req)
+	serve(s, request(http.MethodGet, "/hash/1", nil))
+	serve(s, request(http.MethodGet, "/hash/2", nil))
+	serve(s, request(http.MethodGet, "/foo", nil))
+	res := serve(s, request(http.MethodGet, "/metrics", nil))
+	equal(t, http.StatusOK, res.Result().StatusCode)
+	output := res.Body.String()
+	lines := []string{
+		`http_requests_total{route="/hash",method="POST",code="200"} 1`,
+		`http_requests_total{route="/hash/{id}",method="GET",code="202"} 1`,
+		`http_requests_total{route="/hash/{id}",method="GET",code="404"} 1`,
+		`http_requests_total{route="other",method="GET",code="404"} 1`,
+		`http_request_duration_seconds_count{route="/hash/{id}",method="GET"} 2`,
+		`store_hashes 0`,
+		`store_pending_writes 1`,
+	}
+	for _, line := range lines {
+		equal(t, true, strings.Contains(output, line+"\n"))
+	}
 }
 
 func TestBadRequest(t *testing.T) {
-	s := NewHashingService(0, false)
+	s := newService()
 	defer s.Close()
 
 	casesPost := map[string]string{
@@ -99,11 +533,13 @@ func TestBadRequest(t *testing.T) {
 }
 
 func TestNotAllowed(t *testing.T) {
-	s := NewHashingService(0, false)
+	s := newService()
 	defer s.Close()
 
 	cases := map[string]string{
 		"/stats":    http.MethodPost,
+		"/events":   http.MethodPost,
+		"/metrics":  http.MethodPost,
 		"/hash/":    http.MethodPut,
 		"/hash/1":   http.MethodDelete,
 		"/shutdown": http.MethodPatch,
@@ -116,7 +552,7 @@ func TestNotAllowed(t *testing.T) {
 }
 
 func TestNotFound(t *testing.T) {
-	s := NewHashingService(0, false)
+	s := newService()
 	defer s.Close()
 
 	cases := map[string]string{
@@ -133,22 +569,64 @@ func TestNotFound(t *testing.T) {
 }
 
 func TestShutdown(t *testing.T) {
-	s := NewHashingService(0, false)
+	s := newService()
 	defer s.Close()
-	// Wait for the shutdown signal
-	quit := false
+	// Wait for the shutdown signal, handed over on a channel
+	// as sharing a variable with the routine is a data race
+	quit := make(chan bool, 1)
 	go func() {
-		quit = <-s.Shutdown()
+		quit <- <-s.Shutdown()
 	}()
-	// Let the go routine start
-	time.Sleep(10 * time.Millisecond)
-	// Shutdown the service
+	// Shutdown the service, requests are rejected until
+	// the go routine is receiving on the channel
 	res := serve(s, request(http.MethodGet, "/shutdown", nil))
-	// Let the scheduler return the channel value to check results
-	time.Sleep(10 * time.Millisecond)
+	for res.Result().StatusCode == http.StatusConflict {
+		runtime.Gosched()
+		res = serve(s, request(http.MethodGet, "/shutdown", nil))
+	}
 	equal(t, http.StatusOK, res.Result().StatusCode)
-	equal(t, true, quit)
+	equal(t, true, <-quit)
 	// Call again to get the blocking state of the channel write
 	res = serve(s, request(http.MethodGet, "/shutdown", nil))
 	equal(t, http.StatusConflict, res.Result().StatusCode)
 }
+
+// New hashes are rejected once draining, Close is safe to call many
+// times (even concurrently with shutdown requests), run with -race
+func TestLifecycle(t *testing.T) {
+	c := fake()
+	s := NewHashingService(app.New(store.NewMemory(50*time.Millisecond, store.WithClock(c))), false, WithClock(c))
+	post := func() *httptest.ResponseRecorder {
+		req := request(http.MethodPost, "/hash", strings.NewReader("password=secret"))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		return serve(s, req)
+	}
+	equal(t, http.StatusOK, post().Result().StatusCode)
+	s.Drain()
+	equal(t, store.STATE_DRAINING, s.application.State())
+	equal(t, http.StatusServiceUnavailable, post().Result().StatusCode)
+	// Hashes are still readable while draining
+	c.Advance(50 * time.Millisecond)
+	res := serve(s, request(http.MethodGet, "/hash/1?wait=1s", nil))
+	equal(t, http.StatusOK, res.Result().StatusCode)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			equal(t, nil, s.Close())
+		}()
+		go func() {
+			defer wg.Done()
+			serve(s, request(http.MethodGet, "/shutdown", nil))
+		}()
+	}
+	wg.Wait()
+	equal(t, store.STATE_CLOSED, s.application.State())
+	_, ok := <-s.Shutdown()
+	equal(t, false, ok)
+	res = serve(s, request(http.MethodGet, "/hash/1", nil))
+	equal(t, http.StatusServiceUnavailable, res.Result().StatusCode)
+	res = serve(s, request(http.MethodGet, "/shutdown", nil))
+	equal(t, http.StatusConflict, res.Result().StatusCode)
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Plain text is the default for backward compatibility, structured JSON
+// is only used when the client asks for it with the Accept header, and
+// request bodies can be either form encoded or JSON (Content-Type).
+
+// Status of a hash as reported on JSON responses
+const (
+	STATUS_PENDING   = "pending"
+	STATUS_PERSISTED = "persisted"
+)
+
+// hashResponse is the JSON representation of a hash, CreatedAt is only
+// known when the hash is accepted as it is not saved in the Store.
+type hashResponse struct {
+	ID        int        `json:"id"`
+	Status    string     `json:"status"`
+	Hash      string     `json:"hash,omitempty"`
+	Algorithm string     `json:"algorithm,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+// verifyResponse is the JSON representation of a verification
+type verifyResponse struct {
+	ID       int  `json:"id"`
+	Match    bool `json:"match"`
+	Rehashed bool `json:"rehashed"`
+}
+
+// statusResponse is the JSON representation of simple messages
+type statusResponse struct {
+	Status string `json:"status"`
+}
+
+// problem details for HTTP APIs (RFC 7807), used for JSON errors
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// MAX_BODY_SIZE caps JSON bodies, the same limit net/http applies
+// to form bodies when they are parsed
+const MAX_BODY_SIZE = 10 << 20
+
+// passwordRequest is the JSON body for POST /hash and verify
+type passwordRequest struct {
+	Password string `json:"password"`
+}
+
+// wantsJSON tells if the client prefers a JSON response over plain text,
+// the highest weight (q) of the ranges matching JSON must be strictly
+// higher than the one of those matching plain text, so wildcards alone
+// (e.g. */*) keep the default. A weight of 0 means not acceptable.
+func wantsJSON(r *http.Request) bool {
+	json, text := 0.0, 0.0
+	for _, value := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(value, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			q := 1.0
+			if weight, err := strconv.ParseFloat(params["q"], 64); err == nil {
+				q = weight
+			}
+			switch mediaType {
+			case "application/json", "application/problem+json", "application/*":
+				json = math.Max(json, q)
+			case "text/plain", "text/*":
+				text = math.Max(text, q)
+			case "*/*":
+				json, text = math.Max(json, q), math.Max(text, q)
+			}
+		}
+	}
+	return json > text
+}
+
+// readPassword returns the password from a JSON body or a form
+func readPassword(w http.ResponseWriter, r *http.Request) (string, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return r.FormValue("password"), nil
+	}
+	body := passwordRequest{}
+	reader := http.MaxBytesReader(w, r.Body, MAX_BODY_SIZE)
+	if err := json.NewDecoder(reader).Decode(&body); err != nil {
+		return "", errors.New("invalid JSON body")
+	}
+	return body.Password, nil
+}
+
+// writeJSON writes v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		// Should never fail, all responses are plain structs
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// writeError replaces http.Error, replying with problem details
+// to JSON clients and a plain text message to everyone else.
+func writeError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	if !wantsJSON(r) {
+		http.Error(w, message, status)
+		return
+	}
+	data, _ := json.Marshal(problem{
+		Type:     "about:blank",
+		Title:    statusText(status),
+		Status:   status,
+		Detail:   message,
+		Instance: r.URL.Path,
+	})
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(data)
+}
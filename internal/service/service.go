@@ -17,6 +17,13 @@ type Service interface {
 	Close() error
 }
 
+// Drainer is implemented by services holding long lived connections
+// (streams), Drain is called as soon as the server starts shutting down
+// as it would otherwise wait for those connections until timeout.
+type Drainer interface {
+	Drain()
+}
+
 // MockService for testing purposes, modify as needed
 type MockService struct {
 	quit chan bool
@@ -0,0 +1,125 @@
+package stats
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+)
+
+// Log-linear (HDR style) histogram of int64 values: every power of two
+// range is split in 2^SUB_BITS linear sub-buckets, values below 2^SUB_BITS
+// are exact and the relative error for the rest is at most 1/2^SUB_BITS
+// (6.25%). Buckets are fixed, so recording is a single atomic increment
+// with no locks or allocations, cheap enough for every request.
+const SUB_BITS = 4
+
+const (
+	subCount = 1 << SUB_BITS
+	// Enough buckets for any non negative int64 value (63 bits)
+	bucketCount = (63-SUB_BITS)*subCount + subCount
+)
+
+// histogram is safe for concurrent use, created with newHistogram
+type histogram struct {
+	counts [bucketCount]uint64
+	min    int64
+	max    int64
+}
+
+// newHistogram returns an empty histogram, min starts at the highest
+// value (zero is a valid value) so any recorded value replaces it
+func newHistogram() *histogram {
+	return &histogram{min: math.MaxInt64}
+}
+
+// bucket returns the bucket index for v (negative values are clamped)
+func bucket(v int64) int {
+	if v < subCount {
+		if v < 0 {
+			return 0
+		}
+		return int(v)
+	}
+	// Keep the top SUB_BITS+1 significant bits of v
+	shift := bits.Len64(uint64(v)) - SUB_BITS - 1
+	return (shift+1)*subCount + int(v>>shift) - subCount
+}
+
+// highest returns the highest value that falls into bucket index i
+func highest(i int) int64 {
+	if i < subCount {
+		return int64(i)
+	}
+	shift := i/subCount - 1
+	m := int64(i%subCount + subCount)
+	// Top bucket upper bound overflows int64
+	if i == bucketCount-1 {
+		return math.MaxInt64
+	}
+	return (m+1)<<shift - 1
+}
+
+// record adds a single value to the histogram
+func (h *histogram) record(v int64) {
+	if v < 0 {
+		v = 0
+	}
+	atomic.AddUint64(&h.counts[bucket(v)], 1)
+	for {
+		max := atomic.LoadInt64(&h.max)
+		if v <= max || atomic.CompareAndSwapInt64(&h.max, max, v) {
+			break
+		}
+	}
+	for {
+		min := atomic.LoadInt64(&h.min)
+		if v >= min || atomic.CompareAndSwapInt64(&h.min, min, v) {
+			break
+		}
+	}
+}
+
+// percentiles returns the value at each quantile q (0 < q <= 1), as the
+// highest value of the bucket clamped to the max recorded value.
+func (h *histogram) percentiles(qs ...float64) []int64 {
+	var counts [bucketCount]uint64
+	total := uint64(0)
+	for i := range counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+		total += counts[i]
+	}
+	max := atomic.LoadInt64(&h.max)
+	result := make([]int64, len(qs))
+	if total == 0 {
+		return result
+	}
+	for j, q := range qs {
+		rank := uint64(math.Ceil(q * float64(total)))
+		if rank < 1 {
+			rank = 1
+		}
+		cumulative := uint64(0)
+		for i := range counts {
+			cumulative += counts[i]
+			if cumulative >= rank {
+				result[j] = highest(i)
+				break
+			}
+		}
+		if result[j] > max {
+			result[j] = max
+		}
+	}
+	return result
+}
+
+// bounds returns the min and max recorded values, zero if empty
+func (h *histogram) bounds() (int64, int64) {
+	// min is loaded first, max is always updated before it
+	min := atomic.LoadInt64(&h.min)
+	max := atomic.LoadInt64(&h.max)
+	if min > max {
+		return 0, 0
+	}
+	return min, max
+}
@@ -0,0 +1,88 @@
+package stats
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/phrozen/password-hash-exercise/internal/middleware/labels"
+	"github.com/phrozen/password-hash-exercise/internal/middleware/logger"
+)
+
+// Outcome class that aggregates every status code of a route
+const ALL = "all"
+
+// routeKey identifies the Stats of a route, method and outcome class
+type routeKey struct {
+	route  string
+	method string
+	class  string
+}
+
+// Routes keeps Stats per route, method and outcome class (2xx, 4xx, 5xx),
+// along with the aggregate of every class for each route and method.
+type Routes struct {
+	sync.RWMutex
+	config
+	stats map[routeKey]*Stats
+}
+
+// NewRoutes returns empty per route stats, options apply to every Stats
+func NewRoutes(options ...Option) *Routes {
+	return &Routes{config: newConfig(options), stats: make(map[routeKey]*Stats)}
+}
+
+// Get returns the Stats for route, method and class, which are
+// created on first use, ALL is the aggregate of every class.
+func (r *Routes) Get(route, method, class string) *Stats {
+	key := routeKey{route, method, class}
+	r.RLock()
+	s, ok := r.stats[key]
+	r.RUnlock()
+	if ok {
+		return s
+	}
+	r.Lock()
+	defer r.Unlock()
+	// Might have been created while waiting for the lock
+	if s, ok = r.stats[key]; !ok {
+		s = &Stats{config: r.config, latencies: newHistogram()}
+		r.stats[key] = s
+	}
+	return s
+}
+
+// Add records a request that started at start on both its outcome
+// class (from the status code) and the aggregate of the route.
+func (r *Routes) Add(route, method string, code int, start time.Time) {
+	r.Get(route, method, fmt.Sprintf("%dxx", code/100)).Add(start)
+	r.Get(route, method, ALL).Add(start)
+}
+
+// Snapshot returns the stats of every route keyed by "<method> <route>"
+// and then by outcome class.
+func (r *Routes) Snapshot() map[string]map[string]Response {
+	r.RLock()
+	defer r.RUnlock()
+	snapshot := make(map[string]map[string]Response)
+	for key, s := range r.stats {
+		name := key.method + " " + key.route
+		if _, ok := snapshot[name]; !ok {
+			snapshot[name] = make(map[string]Response)
+		}
+		snapshot[name][key.class] = s.Snapshot()
+	}
+	return snapshot
+}
+
+// Middleware records the stats of every request to next, route is used
+// to map requests to a bounded set of routes (e.g. "/hash/{id}").
+func (r *Routes) Middleware(route func(*http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := r.clock.Now()
+		ro := logger.NewResponseObserver(w, r.clock)
+		next.ServeHTTP(ro, req)
+		r.Add(route(req), labels.Method(req), ro.StatusCode(), start)
+	})
+}
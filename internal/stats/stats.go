@@ -4,44 +4,120 @@ import (
 	"encoding/json"
 	"sync/atomic"
 	"time"
+
+	"github.com/phrozen/password-hash-exercise/internal/clock"
 )
 
+// config is shared by Stats and Routes
+type config struct {
+	clock clock.Clock
+}
+
+// Option configures Stats and Routes
+type Option func(*config)
+
+// WithClock replaces the real clock used to measure requests, tests
+// can use a clock.Fake to get exact latencies and windows.
+func WithClock(c clock.Clock) Option {
+	return func(cfg *config) {
+		cfg.clock = c
+	}
+}
+
+// newConfig applies options over the defaults
+func newConfig(options []Option) config {
+	cfg := config{clock: clock.Real{}}
+	for _, option := range options {
+		option(&cfg)
+	}
+	return cfg
+}
+
 // Stats keeps track of the total number of requests and the
-// total elapsed time in microseconds to calculate an average
+// total elapsed time in microseconds to calculate an average,
+// along with a histogram to calculate latency percentiles
 type Stats struct {
-	requests int64
-	elapsed  int64
+	config
+	requests  int64
+	elapsed   int64
+	latencies *histogram
+	seconds   ring
 }
 
+// Response is the JSON representation of the stats, every
+// value but Total is expressed in microseconds.
 type Response struct {
 	Total   int64 `json:"total"`
 	Average int64 `json:"average"`
+	P50     int64 `json:"p50"`
+	P90     int64 `json:"p90"`
+	P99     int64 `json:"p99"`
+	P999    int64 `json:"p999"`
+	Min     int64 `json:"min"`
+	Max     int64 `json:"max"`
+	// Stats over the rolling windows (1m, 5m, 15m)
+	Windows map[string]Window `json:"windows,omitempty"`
+}
+
+// Select keeps only the window name in the response,
+// returns false if there is no such window.
+func (r *Response) Select(name string) bool {
+	w, ok := r.Windows[name]
+	if !ok {
+		return false
+	}
+	r.Windows = map[string]Window{name: w}
+	return true
 }
 
-// New returns Stats with default zero values can use &Stats{} instead
-func New() *Stats {
-	return &Stats{}
+// New returns Stats with default zero values and the real clock
+func New(options ...Option) *Stats {
+	return &Stats{config: newConfig(options), latencies: newHistogram()}
 }
 
 // Add calculates the delta in time between Now and start
 // and atomically increases the stats counters
 func (s *Stats) Add(start time.Time) {
-	delta := time.Now().UnixMicro() - start.UnixMicro()
+	now := s.clock.Now()
+	delta := now.UnixMicro() - start.UnixMicro()
 	atomic.AddInt64(&s.elapsed, delta)
 	atomic.AddInt64(&s.requests, 1)
+	s.latencies.record(delta)
+	s.seconds.add(now.Unix(), delta)
 }
 
-// JSON returns the JSON representation of the stats to
-// be consumed by a handler as per the requirements
-func (s *Stats) JSON() ([]byte, error) {
+// Snapshot returns the current stats, useful to compose
+// the stats of several endpoints into a single response
+func (s *Stats) Snapshot() Response {
+	requests := atomic.LoadInt64(&s.requests)
+	elapsed := atomic.LoadInt64(&s.elapsed)
 	avg := int64(0)
 	// avoid division by zero
-	if s.requests > 0 {
-		avg = s.elapsed / s.requests
+	if requests > 0 {
+		avg = elapsed / requests
+	}
+	p := s.latencies.percentiles(0.5, 0.9, 0.99, 0.999)
+	min, max := s.latencies.bounds()
+	now := s.clock.Now().Unix()
+	windows := make(map[string]Window, len(WINDOWS))
+	for _, w := range WINDOWS {
+		windows[w.Name] = s.seconds.window(now, w.Duration)
 	}
-	res := Response{
-		Total:   s.requests,
+	return Response{
+		Total:   requests,
 		Average: avg,
+		P50:     p[0],
+		P90:     p[1],
+		P99:     p[2],
+		P999:    p[3],
+		Min:     min,
+		Max:     max,
+		Windows: windows,
 	}
-	return json.Marshal(res)
+}
+
+// JSON returns the JSON representation of the stats to
+// be consumed by a handler as per the requirements
+func (s *Stats) JSON() ([]byte, error) {
+	return json.Marshal(s.Snapshot())
 }
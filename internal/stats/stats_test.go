@@ -2,9 +2,15 @@ package stats
 
 import (
 	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"runtime"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/phrozen/password-hash-exercise/internal/clock"
 )
 
 // WARNING: Don't use this, use testify instead!
@@ -18,11 +24,18 @@ func equal(t *testing.T, want, have any) {
 	}
 }
 
+// Fake clock for exact latencies, it only moves with Advance
+func fake() *clock.Fake {
+	return clock.NewFake(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+}
+
 func TestStats(t *testing.T) {
-	s := New()
-	// Test request counter
-	start := time.Now()
+	c := fake()
+	s := New(WithClock(c))
+	// Test request counter, request i takes i microseconds
 	for i := 1; i <= 100; i++ {
+		start := c.Now()
+		c.Advance(time.Duration(i) * time.Microsecond)
 		s.Add(start)
 		equal(t, int64(i), s.requests)
 	}
@@ -38,5 +51,152 @@ func TestStats(t *testing.T) {
 	equal(t, true, err == nil)
 	err = json.Unmarshal(data, &have)
 	equal(t, true, err == nil)
-	equal(t, want, have)
+	equal(t, want.Total, have.Total)
+	equal(t, want.Average, have.Average)
+	// Percentiles report the upper bound of their bucket
+	equal(t, int64(50), have.Average)
+	equal(t, int64(51), have.P50)
+	equal(t, int64(91), have.P90)
+	equal(t, int64(99), have.P99)
+	equal(t, int64(100), have.P999)
+	equal(t, int64(1), have.Min)
+	equal(t, int64(100), have.Max)
+	equal(t, int64(100), have.Windows["1m"].Total)
+}
+
+func TestWindows(t *testing.T) {
+	r := &ring{}
+	now := fake().Now().Unix()
+	// 1 request per second for the last 10 minutes
+	for i := int64(0); i < 600; i++ {
+		r.add(now-i, 100)
+	}
+	w := r.window(now, time.Minute)
+	equal(t, Window{Total: 60, Rate: 1, Average: 100}, w)
+	w = r.window(now, 5*time.Minute)
+	equal(t, Window{Total: 300, Rate: 1, Average: 100}, w)
+	w = r.window(now, 15*time.Minute)
+	equal(t, Window{Total: 600, Rate: 600.0 / 900, Average: 100}, w)
+	// A full lap later everything is reset
+	r.add(now+RING_SIZE, 50)
+	w = r.window(now+RING_SIZE, 15*time.Minute)
+	equal(t, Window{Total: 1, Rate: 1.0 / 900, Average: 50}, w)
+	// Late requests for reused buckets are dropped
+	r.add(now, 100)
+	w = r.window(now+RING_SIZE, 15*time.Minute)
+	equal(t, int64(1), w.Total)
+
+	c := fake()
+	s := New(WithClock(c))
+	s.Add(c.Now())
+	response := s.Snapshot()
+	equal(t, len(WINDOWS), len(response.Windows))
+	equal(t, int64(1), response.Windows["1m"].Total)
+	// Requests leave the window as time goes by
+	c.Advance(2 * time.Minute)
+	response = s.Snapshot()
+	equal(t, int64(0), response.Windows["1m"].Total)
+	equal(t, int64(1), response.Windows["5m"].Total)
+	equal(t, true, response.Select("5m"))
+	equal(t, 1, len(response.Windows))
+	equal(t, false, response.Select("1h"))
+}
+
+// Requests are tracked by outcome class and on the aggregate
+func TestRoutes(t *testing.T) {
+	r := NewRoutes()
+	handler := r.Middleware(func(req *http.Request) string { return "/hash/{id}" },
+		http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/hash/0" {
+				http.NotFound(w, req)
+			}
+		}))
+	for _, path := range []string{"/hash/1", "/hash/2", "/hash/0"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("BREW", "/hash/1", nil))
+	snapshot := r.Snapshot()
+	equal(t, 2, len(snapshot))
+	equal(t, int64(2), snapshot["GET /hash/{id}"]["2xx"].Total)
+	equal(t, int64(1), snapshot["GET /hash/{id}"]["4xx"].Total)
+	equal(t, int64(3), snapshot["GET /hash/{id}"][ALL].Total)
+	equal(t, int64(1), snapshot["OTHER /hash/{id}"][ALL].Total)
+	// Same Stats are returned once created
+	equal(t, r.Get("/hash/{id}", http.MethodGet, ALL), r.Get("/hash/{id}", http.MethodGet, ALL))
+}
+
+// Exact values for small inputs and bounded error for the rest
+func TestHistogram(t *testing.T) {
+	h := newHistogram()
+	equal(t, int64(0), h.percentiles(0.5)[0])
+	min, max := h.bounds()
+	equal(t, int64(0), min)
+	equal(t, int64(0), max)
+	// 1..1000
+	for v := int64(1000); v > 0; v-- {
+		h.record(v)
+	}
+	p := h.percentiles(0.5, 0.9, 0.99, 0.999, 1)
+	wants := []int64{500, 900, 990, 999, 1000}
+	for i, want := range wants {
+		// Within the histogram precision
+		equal(t, true, p[i] >= want && float64(p[i]) <= float64(want)*(1+1.0/subCount))
+	}
+	min, max = h.bounds()
+	equal(t, int64(1), min)
+	equal(t, int64(1000), max)
+	// Every value falls in a bucket whose highest value is not lower
+	for _, v := range []int64{0, 1, 15, 16, 17, 31, 32, 33, 1 << 40, math.MaxInt64} {
+		i := bucket(v)
+		equal(t, true, highest(i) >= v)
+		if i > 0 {
+			equal(t, true, highest(i-1) < v)
+		}
+	}
+	equal(t, bucketCount-1, bucket(math.MaxInt64))
+}
+
+// Concurrent first records keep the lowest value as min, zero included
+func TestHistogramMin(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		h := newHistogram()
+		var wg sync.WaitGroup
+		for v := int64(8); v >= 0; v-- {
+			wg.Add(1)
+			go func(v int64) {
+				defer wg.Done()
+				h.record(v)
+			}(v)
+		}
+		wg.Wait()
+		min, max := h.bounds()
+		equal(t, int64(0), min)
+		equal(t, int64(8), max)
+	}
+}
+
+// Add must stay cheap (no locks or allocations) under heavy parallel load,
+// run with -cpu 1,8,32 to compare contention
+func BenchmarkAdd(b *testing.B) {
+	s := New()
+	start := time.Now()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			s.Add(start)
+		}
+	})
+}
+
+func BenchmarkSnapshot(b *testing.B) {
+	s := New()
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		s.Add(start.Add(-time.Duration(i) * time.Millisecond))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Snapshot()
+	}
 }
@@ -0,0 +1,89 @@
+package stats
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// Rolling windows reported on every response, like load averages
+var WINDOWS = []struct {
+	Name     string
+	Duration time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"15m", 15 * time.Minute},
+}
+
+// One bucket per second for the longest window
+const RING_SIZE = 15 * 60
+
+// Window is the request rate (per second) and average latency
+// (microseconds) for the requests done in the last Duration.
+type Window struct {
+	Total   int64   `json:"total"`
+	Rate    float64 `json:"rate"`
+	Average int64   `json:"average"`
+}
+
+// second is a ring bucket, it holds the requests done in a single
+// second, and is reset when the ring wraps around to a new second.
+type second struct {
+	unix     int64
+	requests int64
+	elapsed  int64
+}
+
+// ring of per second buckets, lock free for writers: the only contention
+// is resetting a bucket, which happens once per second at most.
+type ring struct {
+	buckets [RING_SIZE]second
+}
+
+// Marks a bucket being reset, no valid unix second is negative here
+const resetting = -1
+
+// add records a request done at unix second now
+func (r *ring) add(now, elapsed int64) {
+	b := &r.buckets[now%RING_SIZE]
+	for {
+		unix := atomic.LoadInt64(&b.unix)
+		switch {
+		case unix == now:
+			atomic.AddInt64(&b.requests, 1)
+			atomic.AddInt64(&b.elapsed, elapsed)
+			return
+		case unix == resetting:
+			// Someone else is resetting it right now
+			runtime.Gosched()
+		case unix > now:
+			// Too late, the bucket was already reused
+			return
+		case atomic.CompareAndSwapInt64(&b.unix, unix, resetting):
+			atomic.StoreInt64(&b.requests, 0)
+			atomic.StoreInt64(&b.elapsed, 0)
+			atomic.StoreInt64(&b.unix, now)
+		}
+	}
+}
+
+// window aggregates the buckets in the last d up to unix second now
+func (r *ring) window(now int64, d time.Duration) Window {
+	seconds := int64(d / time.Second)
+	w := Window{}
+	elapsed := int64(0)
+	for i := int64(0); i < seconds && i < RING_SIZE; i++ {
+		b := &r.buckets[(now-i)%RING_SIZE]
+		if atomic.LoadInt64(&b.unix) != now-i {
+			continue
+		}
+		w.Total += atomic.LoadInt64(&b.requests)
+		elapsed += atomic.LoadInt64(&b.elapsed)
+	}
+	if w.Total > 0 {
+		w.Average = elapsed / w.Total
+	}
+	w.Rate = float64(w.Total) / float64(seconds)
+	return w
+}
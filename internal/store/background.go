@@ -0,0 +1,30 @@
+package store
+
+import "context"
+
+// Background adapts a Store for callers written before operations
+// took a context, every operation runs with context.Background()
+// so it can't be cancelled, just like it used to be.
+type Background struct {
+	Store
+}
+
+// NewBackground returns the adapter for the given Store
+func NewBackground(s Store) Background {
+	return Background{s}
+}
+
+// Get returns the value at index id, see Store
+func (b Background) Get(id int) ([]byte, error) {
+	return b.Store.Get(context.Background(), id)
+}
+
+// Set saves the value and returns its id, see Store
+func (b Background) Set(value []byte) (int, error) {
+	return b.Store.Set(context.Background(), value)
+}
+
+// Update replaces the value at index id, see Store
+func (b Background) Update(id int, value []byte) error {
+	return b.Store.Update(context.Background(), id, value)
+}
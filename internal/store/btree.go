@@ -0,0 +1,858 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BTREE_FILE_NAME is the name of the page file inside the data directory
+const BTREE_FILE_NAME = "hashes.db"
+
+// PAGE_SIZE is the size of every page in the file, the usual block size
+const PAGE_SIZE = 4096
+
+// Pages 0 and 1 are meta pages, written in turns by every transaction:
+//   - magic "PHBT" (4 bytes) and version (uint32)
+//   - transaction id, root page, number of pages, id counter, number
+//     of values and first page of the free list, 0 if empty (uint64 each)
+//   - CRC32 (Castagnoli) of the page in its last 4 bytes
+//
+// The free list is written on as many pages as needed, each starting with
+// its type (byte) and number of free pages on it (uint16), followed by the
+// next page of the list, 0 on the last one (uint64) and the free pages.
+//
+// Every other page is a node of the tree, starting with its type (byte)
+// and number of keys (uint16):
+//   - leaves hold (id, length, value) cells sorted by id, values larger
+//     than maxInline are written on contiguous overflow pages instead and
+//     the cell holds the first one (uint64)
+//   - internal nodes hold the first child (uint64) followed by (key, child)
+//     pairs, every id in a child is >= the key on its left
+const (
+	btreeMagic   = "PHBT"
+	btreeVersion = 2
+	pageLeaf     = 1
+	pageInternal = 2
+	pageFree     = 3
+	pageHeader   = 1 + 2
+	maxFree      = (PAGE_SIZE - pageHeader - 8) / 8
+	maxKeys      = (PAGE_SIZE - pageHeader - 8) / 16
+	maxInline    = 1024
+	cellHeader   = 8 + 4
+	leafCapacity = PAGE_SIZE - pageHeader
+)
+
+// ErrCorrupt is returned when the page file can't be trusted
+var ErrCorrupt = errors.New("Corrupt")
+
+// BTree implements a Store backed by a single file of fixed size pages,
+// holding a B+tree keyed by id with the same autoincrement keys and
+// delayed writes as every other store. Lookups are O(log n) and read
+// pages from disk on demand, only the meta page is kept in memory, so
+// memory is bounded no matter how many values are stored.
+//
+// Pages are never modified in place (copy-on-write): every write copies
+// the path from the leaf to the root on new pages, syncs them and only
+// then writes the meta page pointing to the new root, alternating between
+// the two meta pages. A crash mid-write leaves the previous meta page and
+// the pages it points to untouched, on startup the valid meta page with
+// the highest transaction id wins. Pages left behind by a transaction are
+// reused by the next ones, the free list is written along with them on
+// pages of its own, so none are leaked no matter how many are freed at
+// once, and large values take runs of contiguous free pages if any, so
+// the file stays flat while values are replaced. The writes due at the
+// same time are done in a single transaction, so a
+// burst of writes costs a couple of syncs instead of two per write.
+type BTree struct {
+	sync.RWMutex
+	file      *os.File
+	meta      meta
+	err       error
+	scheduler *scheduler
+}
+
+// meta is the state of the tree as of the last transaction, free is
+// kept sorted and lists holds the pages it is written on, in order
+type meta struct {
+	txid    uint64
+	root    uint64
+	pages   uint64
+	counter uint64
+	count   uint64
+	free    []uint64
+	lists   []uint64
+}
+
+// node is a decoded page, leaves hold cells and internal nodes children
+type node struct {
+	leaf     bool
+	keys     []uint64
+	cells    []cell
+	children []uint64
+}
+
+// cell is the value of an id on a leaf, inline values are kept on the
+// leaf itself while larger ones are read from the overflow pages
+type cell struct {
+	length   int
+	inline   []byte
+	overflow uint64
+}
+
+// size of the cell once encoded, id included
+func (c cell) size() int {
+	if c.overflow != 0 {
+		return cellHeader + 8
+	}
+	return cellHeader + c.length
+}
+
+// NewBTree opens (or creates) the page file inside dir with 'delay' writes,
+// recovering the tree as of the last transaction written in full.
+func NewBTree(dir string, delay time.Duration, options ...Option) (*BTree, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, BTREE_FILE_NAME), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	b := &BTree{file: file}
+	b.scheduler = newScheduler(delay, b.write, options...)
+	b.scheduler.durable = b.durable
+	b.scheduler.batch = b.writeAll
+	if err := b.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	// Keep autoincrement going from the last persisted id,
+	// then write the ones still pending on the last run
+	b.scheduler.count = int64(b.meta.counter)
+	b.scheduler.replay(b.has)
+	if b.err != nil {
+		file.Close()
+		return nil, b.err
+	}
+	return b, nil
+}
+
+// load reads the latest valid meta page, new files get an empty tree
+func (b *BTree) load() error {
+	info, err := b.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return b.init()
+	}
+	found := false
+	head := uint64(0)
+	page := make([]byte, PAGE_SIZE)
+	for i := int64(0); i < 2; i++ {
+		if _, err := b.file.ReadAt(page, i*PAGE_SIZE); err != nil {
+			continue
+		}
+		m, list, ok := decodeMeta(page)
+		if ok && (!found || m.txid > b.meta.txid) {
+			b.meta, head, found = m, list, true
+		}
+	}
+	if found {
+		return b.loadFree(head)
+	}
+	// Transactions write past the first root, if the file has nothing
+	// else the crash was during init and nothing was ever committed
+	if info.Size() <= 3*PAGE_SIZE {
+		return b.init()
+	}
+	return fmt.Errorf("%w: no valid meta page", ErrCorrupt)
+}
+
+// loadFree reads the free list chained from the page head, written
+// (and synced) before the meta page pointing to it
+func (b *BTree) loadFree(head uint64) error {
+	for pgid := head; pgid != 0; {
+		// Every page is on the list once, a longer chain is a loop
+		if pgid < 2 || pgid >= b.meta.pages || uint64(len(b.meta.lists)) >= b.meta.pages {
+			return fmt.Errorf("%w: free list page %d out of range", ErrCorrupt, pgid)
+		}
+		page := make([]byte, PAGE_SIZE)
+		if _, err := b.file.ReadAt(page, int64(pgid)*PAGE_SIZE); err != nil {
+			return err
+		}
+		next, free, ok := decodeFree(page)
+		if !ok {
+			return fmt.Errorf("%w: free list page %d", ErrCorrupt, pgid)
+		}
+		b.meta.lists = append(b.meta.lists, pgid)
+		b.meta.free = append(b.meta.free, free...)
+		pgid = next
+	}
+	return nil
+}
+
+// init writes an empty leaf as the root and then the first meta page
+func (b *BTree) init() error {
+	b.meta = meta{root: 2, pages: 3}
+	if _, err := b.file.WriteAt(encodeNode(&node{leaf: true}), 2*PAGE_SIZE); err != nil {
+		return err
+	}
+	if err := b.file.Sync(); err != nil {
+		return err
+	}
+	if _, err := b.file.WriteAt(encodeMeta(b.meta), 0); err != nil {
+		return err
+	}
+	return b.file.Sync()
+}
+
+// Get returns the value at index id or an error otherwise,
+// ErrPending if the write is yet to be done or ErrNotFound.
+func (b *BTree) Get(ctx context.Context, id int) ([]byte, error) {
+	// Reads from disk can't be cancelled, stop before doing any I/O
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	missing := b.scheduler.lookup(id)
+	// Held during the read, so the file is not closed under it
+	b.RLock()
+	defer b.RUnlock()
+	if err := b.scheduler.state.Readable(); err != nil {
+		return nil, err
+	}
+	n, i, err := b.find(uint64(id))
+	if err != nil {
+		return nil, err
+	}
+	if n == nil {
+		return nil, missing
+	}
+	return b.value(n.cells[i])
+}
+
+// Set saves the value and returns the index where data will
+// be written to the tree after delay, it does not block.
+func (b *BTree) Set(ctx context.Context, value []byte) (int, error) {
+	return b.scheduler.schedule(ctx, value)
+}
+
+// Update replaces the value at index id if it was already written,
+// otherwise returns ErrPending or ErrNotFound like Get.
+func (b *BTree) Update(ctx context.Context, id int, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	missing := b.scheduler.lookup(id)
+	b.Lock()
+	defer b.Unlock()
+	if err := b.scheduler.state.Writable(); err != nil {
+		return err
+	}
+	n, _, err := b.find(uint64(id))
+	if err != nil {
+		return err
+	}
+	if n == nil {
+		return missing
+	}
+	if err := b.scheduler.log(id, value); err != nil {
+		return err
+	}
+	return b.put(uint64(id), value)
+}
+
+// Wait blocks until the pending write of id is done or ctx is done
+func (b *BTree) Wait(ctx context.Context, id int) error {
+	return b.scheduler.wait(ctx, id)
+}
+
+// Observe registers fn to be notified of every write lifecycle event
+func (b *BTree) Observe(fn func(event string, id int)) {
+	b.scheduler.observe(fn)
+}
+
+// Len returns the number of values written
+func (b *BTree) Len() int {
+	b.RLock()
+	defer b.RUnlock()
+	return int(b.meta.count)
+}
+
+// Pending returns the number of writes waiting for delay
+func (b *BTree) Pending() int {
+	return b.scheduler.size()
+}
+
+// Close blocks until all pending writes are in the tree, then closes
+// the file. Returns the first error found while writing, as delayed
+// writes cannot report it to the caller. It is safe to call it again,
+// the same error is returned. Every transaction is synced, so the WAL,
+// if any, is emptied unless there were errors.
+func (b *BTree) Close() error {
+	first := b.scheduler.close()
+	b.Lock()
+	defer b.Unlock()
+	if !first {
+		return b.err
+	}
+	if err := b.scheduler.closeWAL(b.err == nil); err != nil && b.err == nil {
+		b.err = err
+	}
+	if err := b.file.Close(); err != nil && b.err == nil {
+		b.err = err
+	}
+	return b.err
+}
+
+// has tells if id is in the tree, for the scheduler to replay the WAL.
+// Ids that can't be read are missing, so the write fails (sticky error).
+func (b *BTree) has(id int) bool {
+	b.RLock()
+	defer b.RUnlock()
+	n, _, err := b.find(uint64(id))
+	return err == nil && n != nil
+}
+
+// write is called by the scheduler once delay has elapsed, errors
+// are kept to be reported on Close as there is no caller to return to.
+func (b *BTree) write(id int, value []byte) {
+	b.Lock()
+	defer b.Unlock()
+	if err := b.put(uint64(id), value); err != nil && b.err == nil {
+		b.err = err
+	}
+}
+
+// writeAll is write for all the writes due at once, in a single
+// transaction. None of them is done if it fails.
+func (b *BTree) writeAll(writes []write) {
+	b.Lock()
+	defer b.Unlock()
+	tx := b.begin()
+	for _, w := range writes {
+		if err := tx.put(uint64(w.id), w.value); err != nil {
+			if b.err == nil {
+				b.err = err
+			}
+			return
+		}
+	}
+	if err := tx.commit(); err != nil && b.err == nil {
+		b.err = err
+	}
+}
+
+// durable returns the first error found while writing if any, every
+// transaction is synced so the writes applied so far are durable
+func (b *BTree) durable() error {
+	b.Lock()
+	defer b.Unlock()
+	return b.err
+}
+
+// find returns the leaf holding id and its position, or a nil leaf if
+// id is not in the tree. Must be called while holding the lock.
+func (b *BTree) find(id uint64) (*node, int, error) {
+	pgid := b.meta.root
+	for {
+		n, err := b.read(pgid)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !n.leaf {
+			pgid = n.children[n.child(id)]
+			continue
+		}
+		i := sort.Search(len(n.keys), func(i int) bool { return n.keys[i] >= id })
+		if i < len(n.keys) && n.keys[i] == id {
+			return n, i, nil
+		}
+		return nil, 0, nil
+	}
+}
+
+// value returns the value of a leaf cell, reading its overflow pages
+func (b *BTree) value(e cell) ([]byte, error) {
+	if e.overflow == 0 {
+		// Copied, so the page is not kept around with it
+		return append([]byte(nil), e.inline...), nil
+	}
+	value := make([]byte, e.length)
+	if _, err := b.file.ReadAt(value, int64(e.overflow)*PAGE_SIZE); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// put inserts or replaces the value of id in a single transaction,
+// must be called while holding the lock. The tree is left as it was
+// if it fails, pages taken by the failed transaction are reused.
+func (b *BTree) put(id uint64, value []byte) error {
+	tx := b.begin()
+	if err := tx.put(id, value); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// txn is a copy-on-write transaction over the tree, meta is the state
+// of the tree as of the transaction, only visible to it until commit
+type txn struct {
+	tree  *BTree
+	meta  meta
+	fresh map[uint64]bool
+	freed []uint64
+}
+
+// begin starts a transaction, must be called while holding the lock
+func (b *BTree) begin() *txn {
+	tx := &txn{tree: b, meta: b.meta, fresh: make(map[uint64]bool)}
+	tx.meta.free = append([]uint64(nil), b.meta.free...)
+	tx.meta.lists = append([]uint64(nil), b.meta.lists...)
+	return tx
+}
+
+// put inserts or replaces the value of id
+func (tx *txn) put(id uint64, value []byte) error {
+	e, err := tx.cell(value)
+	if err != nil {
+		return err
+	}
+	s, err := tx.insert(tx.meta.root, id, e)
+	if err != nil {
+		return err
+	}
+	tx.meta.root = s.left
+	if s.right != 0 {
+		// Root was split, the tree grows by one level
+		root := &node{keys: []uint64{s.key}, children: []uint64{s.left, s.right}}
+		if tx.meta.root, err = tx.write(root); err != nil {
+			return err
+		}
+	}
+	if id > tx.meta.counter {
+		tx.meta.counter = id
+	}
+	return nil
+}
+
+// split is the result of inserting into a subtree: the copy of its
+// root and, if it had to be split, its new right sibling and the
+// smallest id in it
+type split struct {
+	left, key, right uint64
+}
+
+// insert copies the subtree at pgid with e at id, the old pages
+// are freed once the transaction is done.
+func (tx *txn) insert(pgid, id uint64, e cell) (split, error) {
+	n, err := tx.read(pgid)
+	if err != nil {
+		return split{}, err
+	}
+	tx.free(pgid)
+	if n.leaf {
+		return tx.insertLeaf(n, id, e)
+	}
+	i := n.child(id)
+	s, err := tx.insert(n.children[i], id, e)
+	if err != nil {
+		return split{}, err
+	}
+	n.children[i] = s.left
+	if s.right != 0 {
+		n.keys = insertAt(n.keys, i, s.key)
+		n.children = insertAt(n.children, i+1, s.right)
+	}
+	if len(n.keys) <= maxKeys {
+		left, err := tx.write(n)
+		return split{left: left}, err
+	}
+	// The middle key moves up, it is not kept on any of the halves
+	m := len(n.keys) / 2
+	key := n.keys[m]
+	right := &node{keys: n.keys[m+1:], children: n.children[m+1:]}
+	n.keys, n.children = n.keys[:m], n.children[:m+1]
+	return tx.writeSplit(n, key, right)
+}
+
+// insertLeaf adds or replaces e at id on a leaf, splitting it if needed
+func (tx *txn) insertLeaf(n *node, id uint64, e cell) (split, error) {
+	i := sort.Search(len(n.keys), func(i int) bool { return n.keys[i] >= id })
+	if i < len(n.keys) && n.keys[i] == id {
+		tx.release(n.cells[i])
+		n.cells[i] = e
+	} else {
+		n.keys = insertAt(n.keys, i, id)
+		n.cells = insertAt(n.cells, i, e)
+		tx.meta.count++
+	}
+	if n.size() <= leafCapacity {
+		left, err := tx.write(n)
+		return split{left: left}, err
+	}
+	// Ids are autoincrement, so appends leave the leaf full and start a
+	// new one instead of leaving two half empty leaves behind forever
+	m := len(n.keys) - 1
+	if i != m {
+		m = 0
+		for half := 0; half < n.size()/2; m++ {
+			half += n.cells[m].size()
+		}
+		// Both halves must hold at least one value
+		if m == len(n.keys) {
+			m--
+		}
+	}
+	right := &node{leaf: true, keys: n.keys[m:], cells: n.cells[m:]}
+	n.keys, n.cells = n.keys[:m], n.cells[:m]
+	return tx.writeSplit(n, right.keys[0], right)
+}
+
+// writeSplit writes both halves of a split node
+func (tx *txn) writeSplit(left *node, key uint64, right *node) (split, error) {
+	l, err := tx.write(left)
+	if err != nil {
+		return split{}, err
+	}
+	r, err := tx.write(right)
+	return split{l, key, r}, err
+}
+
+// cell returns the leaf cell for value, writing it on contiguous
+// overflow pages if it is too large
+func (tx *txn) cell(value []byte) (cell, error) {
+	e := cell{length: len(value)}
+	if len(value) <= maxInline {
+		e.inline = value
+		return e, nil
+	}
+	e.overflow = tx.alloc(uint64((len(value) + PAGE_SIZE - 1) / PAGE_SIZE))
+	if _, err := tx.tree.file.WriteAt(value, int64(e.overflow)*PAGE_SIZE); err != nil {
+		return e, err
+	}
+	return e, nil
+}
+
+// release frees the overflow pages of a replaced cell
+func (tx *txn) release(e cell) {
+	if e.overflow == 0 {
+		return
+	}
+	pages := uint64((e.length + PAGE_SIZE - 1) / PAGE_SIZE)
+	for i := uint64(0); i < pages; i++ {
+		tx.free(e.overflow + i)
+	}
+}
+
+// free releases a page replaced by the transaction, pages written by the
+// transaction itself are not pointed to by any meta page, so they can be
+// reused right away (keeping the list sorted), the others once the
+// transaction is done.
+func (tx *txn) free(pgid uint64) {
+	if tx.fresh[pgid] {
+		i := sort.Search(len(tx.meta.free), func(i int) bool { return tx.meta.free[i] >= pgid })
+		tx.meta.free = insertAt(tx.meta.free, i, pgid)
+		return
+	}
+	tx.freed = append(tx.freed, pgid)
+}
+
+// alloc takes the first run of n contiguous free pages, or n new ones at
+// the end of the file if there is none. Single pages are taken from the
+// end of the list, so the runs at its start are kept for large values.
+func (tx *txn) alloc(n uint64) uint64 {
+	free := tx.meta.free
+	pgid := tx.meta.pages
+	switch {
+	case n == 1 && len(free) > 0:
+		pgid, tx.meta.free = free[len(free)-1], free[:len(free)-1]
+	default:
+		start, found := 0, false
+		for i := range free {
+			if i > 0 && free[i] != free[i-1]+1 {
+				start = i
+			}
+			if uint64(i-start+1) == n {
+				pgid, found = free[start], true
+				tx.meta.free = append(free[:start], free[i+1:]...)
+				break
+			}
+		}
+		if !found {
+			tx.meta.pages += n
+		}
+	}
+	for i := uint64(0); i < n; i++ {
+		tx.fresh[pgid+i] = true
+	}
+	return pgid
+}
+
+// write stores n on a free page, or a new one at the end of the file
+func (tx *txn) write(n *node) (uint64, error) {
+	pgid := tx.alloc(1)
+	if _, err := tx.tree.file.WriteAt(encodeNode(n), int64(pgid)*PAGE_SIZE); err != nil {
+		return 0, err
+	}
+	return pgid, nil
+}
+
+// commit syncs the new pages and then writes the meta page not used
+// by the current transaction, pages freed by the transaction can be
+// reused once it is done, as nothing points to them anymore.
+func (tx *txn) commit() error {
+	file := tx.tree.file
+	if err := tx.writeFree(); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	tx.meta.txid++
+	slot := int64(tx.meta.txid % 2)
+	if _, err := file.WriteAt(encodeMeta(tx.meta), slot*PAGE_SIZE); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	tx.tree.meta = tx.meta
+	return nil
+}
+
+// writeFree writes the free list as of the end of the transaction, pages
+// freed by it included, on pages taken from the list before they are
+// added (the current meta page still points to them). The pages of the
+// previous list are freed too, as it is replaced.
+func (tx *txn) writeFree() error {
+	for _, pgid := range tx.meta.lists {
+		tx.free(pgid)
+	}
+	tx.meta.lists = nil
+	// Taking pages shrinks the list, it might end up a page shorter
+	for {
+		count := len(tx.meta.free) + len(tx.freed)
+		if (count+maxFree-1)/maxFree <= len(tx.meta.lists) {
+			break
+		}
+		tx.meta.lists = append(tx.meta.lists, tx.alloc(1))
+	}
+	tx.meta.free = append(tx.meta.free, tx.freed...)
+	sort.Slice(tx.meta.free, func(i, j int) bool { return tx.meta.free[i] < tx.meta.free[j] })
+	tx.freed = nil
+	free := tx.meta.free
+	for i, pgid := range tx.meta.lists {
+		next := uint64(0)
+		if i+1 < len(tx.meta.lists) {
+			next = tx.meta.lists[i+1]
+		}
+		n := len(free)
+		if n > maxFree {
+			n = maxFree
+		}
+		if _, err := tx.tree.file.WriteAt(encodeFree(next, free[:n]), int64(pgid)*PAGE_SIZE); err != nil {
+			return err
+		}
+		free = free[n:]
+	}
+	return nil
+}
+
+// read decodes the node at pgid, pages written by the transaction included
+func (tx *txn) read(pgid uint64) (*node, error) {
+	return tx.tree.node(pgid, tx.meta.pages)
+}
+
+// read decodes the node at pgid
+func (b *BTree) read(pgid uint64) (*node, error) {
+	return b.node(pgid, b.meta.pages)
+}
+
+// node decodes the node at pgid, out of range past the number of pages
+func (b *BTree) node(pgid, pages uint64) (*node, error) {
+	if pgid < 2 || pgid >= pages {
+		return nil, fmt.Errorf("%w: page %d out of range", ErrCorrupt, pgid)
+	}
+	page := make([]byte, PAGE_SIZE)
+	if _, err := b.file.ReadAt(page, int64(pgid)*PAGE_SIZE); err != nil {
+		return nil, err
+	}
+	n, ok := decodeNode(page)
+	if !ok {
+		return nil, fmt.Errorf("%w: page %d", ErrCorrupt, pgid)
+	}
+	return n, nil
+}
+
+// child returns the position of the child holding id
+func (n *node) child(id uint64) int {
+	return sort.Search(len(n.keys), func(i int) bool { return n.keys[i] > id })
+}
+
+// size of the leaf cells once encoded
+func (n *node) size() int {
+	size := 0
+	for _, e := range n.cells {
+		size += e.size()
+	}
+	return size
+}
+
+// insertAt inserts v at position i of s
+func insertAt[T any](s []T, i int, v T) []T {
+	var zero T
+	s = append(s, zero)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+	return s
+}
+
+// encodeNode returns the page for n
+func encodeNode(n *node) []byte {
+	page := make([]byte, PAGE_SIZE)
+	binary.BigEndian.PutUint16(page[1:3], uint16(len(n.keys)))
+	offset := pageHeader
+	if !n.leaf {
+		page[0] = pageInternal
+		binary.BigEndian.PutUint64(page[offset:], n.children[0])
+		offset += 8
+		for i, key := range n.keys {
+			binary.BigEndian.PutUint64(page[offset:], key)
+			binary.BigEndian.PutUint64(page[offset+8:], n.children[i+1])
+			offset += 16
+		}
+		return page
+	}
+	page[0] = pageLeaf
+	for i, key := range n.keys {
+		e := n.cells[i]
+		binary.BigEndian.PutUint64(page[offset:], key)
+		binary.BigEndian.PutUint32(page[offset+8:], uint32(e.length))
+		offset += cellHeader
+		if e.overflow != 0 {
+			binary.BigEndian.PutUint64(page[offset:], e.overflow)
+			offset += 8
+			continue
+		}
+		offset += copy(page[offset:], e.inline)
+	}
+	return page
+}
+
+// decodeNode reads a node from its page, fails on pages that are not
+// nodes or whose content doesn't fit on the page
+func decodeNode(page []byte) (*node, bool) {
+	count := int(binary.BigEndian.Uint16(page[1:3]))
+	offset := pageHeader
+	switch page[0] {
+	case pageInternal:
+		if count > maxKeys {
+			return nil, false
+		}
+		n := &node{keys: make([]uint64, count), children: make([]uint64, count+1)}
+		n.children[0] = binary.BigEndian.Uint64(page[offset:])
+		offset += 8
+		for i := 0; i < count; i++ {
+			n.keys[i] = binary.BigEndian.Uint64(page[offset:])
+			n.children[i+1] = binary.BigEndian.Uint64(page[offset+8:])
+			offset += 16
+		}
+		return n, true
+	case pageLeaf:
+		n := &node{leaf: true, keys: make([]uint64, count), cells: make([]cell, count)}
+		for i := 0; i < count; i++ {
+			if offset+cellHeader > len(page) {
+				return nil, false
+			}
+			n.keys[i] = binary.BigEndian.Uint64(page[offset:])
+			e := cell{length: int(binary.BigEndian.Uint32(page[offset+8:]))}
+			offset += cellHeader
+			if e.length > maxInline {
+				if offset+8 > len(page) {
+					return nil, false
+				}
+				e.overflow = binary.BigEndian.Uint64(page[offset:])
+				offset += 8
+			} else {
+				if offset+e.length > len(page) {
+					return nil, false
+				}
+				e.inline = page[offset : offset+e.length]
+				offset += e.length
+			}
+			n.cells[i] = e
+		}
+		return n, true
+	}
+	return nil, false
+}
+
+// encodeMeta returns the meta page for m
+func encodeMeta(m meta) []byte {
+	page := make([]byte, PAGE_SIZE)
+	copy(page[0:4], btreeMagic)
+	binary.BigEndian.PutUint32(page[4:8], btreeVersion)
+	binary.BigEndian.PutUint64(page[8:16], m.txid)
+	binary.BigEndian.PutUint64(page[16:24], m.root)
+	binary.BigEndian.PutUint64(page[24:32], m.pages)
+	binary.BigEndian.PutUint64(page[32:40], m.counter)
+	binary.BigEndian.PutUint64(page[40:48], m.count)
+	if len(m.lists) > 0 {
+		binary.BigEndian.PutUint64(page[48:56], m.lists[0])
+	}
+	binary.BigEndian.PutUint32(page[PAGE_SIZE-4:], crc32.Checksum(page[:PAGE_SIZE-4], crcTable))
+	return page
+}
+
+// decodeMeta reads a meta page and the first page of its free list,
+// fails if it is torn or unknown
+func decodeMeta(page []byte) (meta, uint64, bool) {
+	if string(page[0:4]) != btreeMagic || binary.BigEndian.Uint32(page[4:8]) != btreeVersion {
+		return meta{}, 0, false
+	}
+	if binary.BigEndian.Uint32(page[PAGE_SIZE-4:]) != crc32.Checksum(page[:PAGE_SIZE-4], crcTable) {
+		return meta{}, 0, false
+	}
+	m := meta{
+		txid:    binary.BigEndian.Uint64(page[8:16]),
+		root:    binary.BigEndian.Uint64(page[16:24]),
+		pages:   binary.BigEndian.Uint64(page[24:32]),
+		counter: binary.BigEndian.Uint64(page[32:40]),
+		count:   binary.BigEndian.Uint64(page[40:48]),
+	}
+	return m, binary.BigEndian.Uint64(page[48:56]), true
+}
+
+// encodeFree returns a page of the free list holding free, up to maxFree
+func encodeFree(next uint64, free []uint64) []byte {
+	page := make([]byte, PAGE_SIZE)
+	page[0] = pageFree
+	binary.BigEndian.PutUint16(page[1:3], uint16(len(free)))
+	binary.BigEndian.PutUint64(page[pageHeader:], next)
+	for i, pgid := range free {
+		binary.BigEndian.PutUint64(page[pageHeader+8+i*8:], pgid)
+	}
+	return page
+}
+
+// decodeFree reads a page of the free list, fails on other pages
+func decodeFree(page []byte) (uint64, []uint64, bool) {
+	count := int(binary.BigEndian.Uint16(page[1:3]))
+	if page[0] != pageFree || count > maxFree {
+		return 0, nil, false
+	}
+	free := make([]uint64, count)
+	for i := range free {
+		free[i] = binary.BigEndian.Uint64(page[pageHeader+8+i*8:])
+	}
+	return binary.BigEndian.Uint64(page[pageHeader:]), free, true
+}
@@ -0,0 +1,207 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// depth returns the number of levels of the tree
+func depth(t *testing.T, b *BTree) int {
+	levels := 1
+	n, err := b.read(b.meta.root)
+	for err == nil && !n.leaf {
+		levels++
+		n, err = b.read(n.children[0])
+	}
+	equal(t, nil, err)
+	return levels
+}
+
+// Values that fill a few leaves each make the tree grow a couple of
+// levels, every value is found and replaced after the splits
+func TestBTreeSplits(t *testing.T) {
+	b, err := NewBTree(t.TempDir(), 0)
+	equal(t, nil, err)
+	defer b.Close()
+	value := func(i int) []byte {
+		return bytes.Repeat([]byte{byte(i)}, maxInline)
+	}
+	const VALUES = 1000
+	for i := 1; i <= VALUES; i++ {
+		b.write(i, value(i))
+	}
+	equal(t, nil, b.err)
+	equal(t, VALUES, b.Len())
+	equal(t, 3, depth(t, b))
+	// Appends leave full leaves behind
+	equal(t, true, b.meta.pages < VALUES/3+VALUES/maxKeys+16)
+	for _, i := range []int{1, 2, 500, 999, VALUES} {
+		output, err := b.Get(context.Background(), i)
+		equal(t, nil, err)
+		equal(t, true, bytes.Equal(value(i), output))
+		// Replaced with a larger (overflow) and a smaller value
+		equal(t, nil, b.Update(context.Background(), i, bytes.Repeat([]byte("x"), 2*PAGE_SIZE)))
+		output, _ = b.Get(context.Background(), i)
+		equal(t, 2*PAGE_SIZE, len(output))
+		equal(t, nil, b.Update(context.Background(), i, []byte("small")))
+		output, _ = b.Get(context.Background(), i)
+		equal(t, "small", string(output))
+	}
+	equal(t, VALUES, b.Len())
+	_, err = b.Get(context.Background(), VALUES+1)
+	equal(t, ErrNotFound, err)
+	// Free pages are reused, the file stops growing
+	pages := b.meta.pages
+	for i := 0; i < 100; i++ {
+		b.Update(context.Background(), 500, []byte(fmt.Sprint(i)))
+	}
+	equal(t, pages, b.meta.pages)
+}
+
+// Close must flush pending writes and a new store on the
+// same directory must recover data and keep the counter
+func TestBTreeRecovery(t *testing.T) {
+	dir := t.TempDir()
+	c := fake()
+	b, err := NewBTree(dir, 50*time.Millisecond, WithClock(c))
+	equal(t, nil, err)
+	for i := 1; i <= 10; i++ {
+		b.Set(context.Background(), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	closed := make(chan error)
+	go func() { closed <- b.Close() }()
+	c.Advance(50 * time.Millisecond)
+	equal(t, nil, <-closed)
+
+	b, err = NewBTree(dir, 0)
+	equal(t, nil, err)
+	defer b.Close()
+	equal(t, 10, b.Len())
+	for i := 1; i <= 10; i++ {
+		output, err := b.Get(context.Background(), i)
+		equal(t, nil, err)
+		equal(t, fmt.Sprintf("value-%d", i), string(output))
+	}
+	index, err := b.Set(context.Background(), []byte("value-11"))
+	equal(t, nil, err)
+	equal(t, 11, index)
+}
+
+// A meta page torn by a crash mid-write is ignored, the tree is
+// recovered as of the previous transaction
+func TestBTreeTorn(t *testing.T) {
+	dir := t.TempDir()
+	b, _ := NewBTree(dir, 0)
+	b.write(1, []byte("first"))
+	b.write(2, []byte("second"))
+	slot := int64(b.meta.txid % 2)
+	equal(t, nil, b.Close())
+	path := filepath.Join(dir, BTREE_FILE_NAME)
+	file, _ := os.OpenFile(path, os.O_WRONLY, 0600)
+	file.WriteAt([]byte("torn"), slot*PAGE_SIZE+100)
+	file.Close()
+
+	b, err := NewBTree(dir, 0)
+	equal(t, nil, err)
+	equal(t, 1, b.Len())
+	_, err = b.Get(context.Background(), 2)
+	equal(t, ErrNotFound, err)
+	id, _ := b.Set(context.Background(), []byte("again"))
+	equal(t, 2, id)
+	equal(t, nil, b.Close())
+
+	// Nothing to recover from without meta pages
+	file, _ = os.OpenFile(path, os.O_WRONLY, 0600)
+	file.WriteAt(make([]byte, 2*PAGE_SIZE), 0)
+	file.Close()
+	_, err = NewBTree(dir, 0)
+	equal(t, true, errors.Is(err, ErrCorrupt))
+}
+
+// Writes due at the same time are done in a single transaction, the
+// pages written by it are reused by the next writes in it
+func TestBTreeBatch(t *testing.T) {
+	c := fake()
+	b, err := NewBTree(t.TempDir(), 50*time.Millisecond, WithClock(c))
+	equal(t, nil, err)
+	for i := 1; i <= 100; i++ {
+		b.Set(context.Background(), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	closed := make(chan error)
+	go func() { closed <- b.Close() }()
+	c.Advance(50 * time.Millisecond)
+	equal(t, nil, <-closed)
+	equal(t, uint64(1), b.meta.txid)
+	equal(t, 100, b.Len())
+	// The root leaf and its copy, the free list, plus the meta pages
+	equal(t, uint64(5), b.meta.pages)
+}
+
+// Replacing a large value frees more pages than fit on a single page of
+// the free list, none are leaked and the next values reuse their run, so
+// the file stays flat, across restarts too
+func TestBTreeFreeList(t *testing.T) {
+	dir := t.TempDir()
+	b, err := NewBTree(dir, 0)
+	equal(t, nil, err)
+	value := func(i int) []byte {
+		return bytes.Repeat([]byte{byte(i)}, 4<<20)
+	}
+	b.write(1, value(0))
+	b.write(1, value(1))
+	equal(t, nil, b.err)
+	equal(t, true, len(b.meta.free) > maxFree)
+	equal(t, true, len(b.meta.lists) > 1)
+	// Both runs and the pages of the free list are in place by now
+	equal(t, nil, b.Update(context.Background(), 1, value(2)))
+	info, _ := b.file.Stat()
+	size := info.Size()
+	for i := 3; i < 20; i++ {
+		equal(t, nil, b.Update(context.Background(), 1, value(i)))
+		info, _ := b.file.Stat()
+		equal(t, size, info.Size())
+	}
+	free := len(b.meta.free)
+	equal(t, nil, b.Close())
+
+	b, err = NewBTree(dir, 0)
+	equal(t, nil, err)
+	defer b.Close()
+	equal(t, free, len(b.meta.free))
+	output, _ := b.Get(context.Background(), 1)
+	equal(t, true, bytes.Equal(value(19), output))
+	equal(t, nil, b.Update(context.Background(), 1, value(20)))
+	info, _ = b.file.Stat()
+	equal(t, size, info.Size())
+}
+
+// A crash while creating the file leaves no meta page behind,
+// as nothing was committed yet it starts over with an empty tree
+func TestBTreeInit(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, BTREE_FILE_NAME)
+	// Root written, meta pages still empty
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
+	file.WriteAt(encodeNode(&node{leaf: true}), 2*PAGE_SIZE)
+	file.Close()
+
+	b, err := NewBTree(dir, 0)
+	equal(t, nil, err)
+	equal(t, 0, b.Len())
+	id, _ := b.Set(context.Background(), []byte("first"))
+	equal(t, 1, id)
+	equal(t, nil, b.Close())
+
+	b, err = NewBTree(dir, 0)
+	equal(t, nil, err)
+	defer b.Close()
+	output, err := b.Get(context.Background(), 1)
+	equal(t, nil, err)
+	equal(t, "first", string(output))
+}
@@ -0,0 +1,84 @@
+package store_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/phrozen/password-hash-exercise/internal/clock"
+	"github.com/phrozen/password-hash-exercise/internal/store"
+	"github.com/phrozen/password-hash-exercise/internal/store/storetest"
+)
+
+func TestMemoryConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T, delay time.Duration, c clock.Clock) store.Store {
+		return store.NewMemory(delay, store.WithClock(c))
+	})
+}
+
+func TestShardedConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T, delay time.Duration, c clock.Clock) store.Store {
+		return store.NewSharded(delay, store.WithClock(c))
+	})
+}
+
+func TestFileConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T, delay time.Duration, c clock.Clock) store.Store {
+		s, err := store.NewFile(t.TempDir(), delay, store.WithClock(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func TestBTreeConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T, delay time.Duration, c clock.Clock) store.Store {
+		s, err := store.NewBTree(t.TempDir(), delay, store.WithClock(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+// wal opens the WAL of the in-memory stores under dir
+func wal(t *testing.T, dir string) *store.WAL {
+	w, err := store.OpenWAL(filepath.Join(dir, "hashes.wal"), store.SyncPolicy{Mode: store.SYNC_ALWAYS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestMemoryRecovery(t *testing.T) {
+	storetest.RunRecovery(t, func(t *testing.T, dir string, delay time.Duration, c clock.Clock) store.Store {
+		return store.NewMemory(delay, store.WithClock(c), store.WithWAL(wal(t, dir)))
+	})
+}
+
+func TestShardedRecovery(t *testing.T) {
+	storetest.RunRecovery(t, func(t *testing.T, dir string, delay time.Duration, c clock.Clock) store.Store {
+		return store.NewSharded(delay, store.WithClock(c), store.WithWAL(wal(t, dir)))
+	})
+}
+
+func TestFileRecovery(t *testing.T) {
+	storetest.RunRecovery(t, func(t *testing.T, dir string, delay time.Duration, c clock.Clock) store.Store {
+		s, err := store.NewFile(dir, delay, store.WithClock(c), store.WithWAL(wal(t, dir)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func TestBTreeRecovery(t *testing.T) {
+	storetest.RunRecovery(t, func(t *testing.T, dir string, delay time.Duration, c clock.Clock) store.Store {
+		s, err := store.NewBTree(dir, delay, store.WithClock(c), store.WithWAL(wal(t, dir)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
@@ -0,0 +1,41 @@
+package store
+
+import "os"
+
+// Break makes the delayed writes of f fail until restored, as a full
+// disk would, by swapping the log for a read-only handle on it
+func (f *File) Break() (restore func()) {
+	f.Lock()
+	defer f.Unlock()
+	rw := f.file
+	f.file = readOnly(rw)
+	return func() {
+		f.Lock()
+		defer f.Unlock()
+		f.file.Close()
+		f.file = rw
+	}
+}
+
+// Break makes the transactions of b fail until restored, like File.Break
+func (b *BTree) Break() (restore func()) {
+	b.Lock()
+	defer b.Unlock()
+	rw := b.file
+	b.file = readOnly(rw)
+	return func() {
+		b.Lock()
+		defer b.Unlock()
+		b.file.Close()
+		b.file = rw
+	}
+}
+
+// readOnly returns a new read-only handle on the file of rw
+func readOnly(rw *os.File) *os.File {
+	ro, err := os.Open(rw.Name())
+	if err != nil {
+		panic(err)
+	}
+	return ro
+}
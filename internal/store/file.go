@@ -0,0 +1,284 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FILE_NAME is the name of the append-only log inside the data directory
+const FILE_NAME = "hashes.log"
+
+// Every record is written as a fixed size header followed by the value:
+//   - id (uint64)
+//   - value length (uint32)
+//   - CRC32 (Castagnoli) of id, length and value (uint32)
+//
+// The checksum lets replay detect a record torn by a crash mid-write.
+const headerSize = 8 + 4 + 4
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// File implements a Store backed by an append-only log on disk with
+// the same integer autoincrement keys and delayed writes as Memory.
+// Only the offset of each record is kept in memory (index), values
+// are read back from the log on demand.
+//
+// On startup the log is replayed to rebuild the index and the id
+// counter, the first record that is incomplete or fails the checksum
+// is considered torn (crash while appending) and the log is truncated
+// right before it, as nothing after it can be trusted.
+type File struct {
+	sync.RWMutex
+	file      *os.File
+	index     map[int]entry
+	size      int64
+	err       error
+	scheduler *scheduler
+}
+
+// entry is the location of a value in the log
+type entry struct {
+	offset int64
+	length int
+}
+
+// NewFile opens (or creates) the log inside dir with 'delay' writes
+// and replays it to recover the data written on previous runs.
+func NewFile(dir string, delay time.Duration, options ...Option) (*File, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, FILE_NAME), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{file: file, index: make(map[int]entry)}
+	f.scheduler = newScheduler(delay, f.write, options...)
+	f.scheduler.durable = f.sync
+	last, err := f.replay()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	// Keep autoincrement going from the last persisted id,
+	// then append the writes still pending on the last run
+	f.scheduler.count = int64(last)
+	f.scheduler.replay(f.has)
+	if f.err != nil {
+		file.Close()
+		return nil, f.err
+	}
+	return f, nil
+}
+
+// Get returns the value at index id or an error otherwise,
+// ErrPending if the write is yet to be done or ErrNotFound.
+func (f *File) Get(ctx context.Context, id int) ([]byte, error) {
+	// Reads from disk can't be cancelled, stop before doing any I/O
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	missing := f.scheduler.lookup(id)
+	// Held during the read, so the file is not closed under it
+	f.RLock()
+	defer f.RUnlock()
+	if err := f.scheduler.state.Readable(); err != nil {
+		return nil, err
+	}
+	e, ok := f.index[id]
+	if !ok {
+		return nil, missing
+	}
+	value := make([]byte, e.length)
+	if _, err := f.file.ReadAt(value, e.offset); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Set saves the value and returns the index where data will
+// be appended to the log after delay, it does not block.
+func (f *File) Set(ctx context.Context, value []byte) (int, error) {
+	return f.scheduler.schedule(ctx, value)
+}
+
+// Update appends a new record for an id that was already written,
+// replay keeps the last record found for every id so the update
+// survives restarts. Returns ErrPending or ErrNotFound like Get.
+func (f *File) Update(ctx context.Context, id int, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	missing := f.scheduler.lookup(id)
+	f.Lock()
+	defer f.Unlock()
+	if err := f.scheduler.state.Writable(); err != nil {
+		return err
+	}
+	if _, ok := f.index[id]; !ok {
+		return missing
+	}
+	if err := f.scheduler.log(id, value); err != nil {
+		return err
+	}
+	return f.append(id, value)
+}
+
+// Wait blocks until the pending write of id is done or ctx is done
+func (f *File) Wait(ctx context.Context, id int) error {
+	return f.scheduler.wait(ctx, id)
+}
+
+// Observe registers fn to be notified of every write lifecycle event
+func (f *File) Observe(fn func(event string, id int)) {
+	f.scheduler.observe(fn)
+}
+
+// Len returns the number of values written
+func (f *File) Len() int {
+	f.RLock()
+	defer f.RUnlock()
+	return len(f.index)
+}
+
+// Pending returns the number of writes waiting for delay
+func (f *File) Pending() int {
+	return f.scheduler.size()
+}
+
+// Close blocks until all pending writes are appended to the log,
+// then syncs and closes the file. Returns the first error found
+// while writing, as delayed writes cannot report it to the caller.
+// It is safe to call it again, the same error is returned. The WAL,
+// if any, is emptied once the log is synced without errors.
+func (f *File) Close() error {
+	first := f.scheduler.close()
+	f.Lock()
+	defer f.Unlock()
+	if !first {
+		return f.err
+	}
+	if err := f.file.Sync(); err != nil && f.err == nil {
+		f.err = err
+	}
+	if err := f.scheduler.closeWAL(f.err == nil); err != nil && f.err == nil {
+		f.err = err
+	}
+	if err := f.file.Close(); err != nil && f.err == nil {
+		f.err = err
+	}
+	return f.err
+}
+
+// has tells if id was written, for the scheduler to replay the WAL
+func (f *File) has(id int) bool {
+	f.RLock()
+	defer f.RUnlock()
+	_, ok := f.index[id]
+	return ok
+}
+
+// write is called by the scheduler once delay has elapsed, errors
+// are kept to be reported on Close as there is no caller to return to.
+func (f *File) write(id int, value []byte) {
+	// Appends must be serialized to keep offsets consistent
+	f.Lock()
+	defer f.Unlock()
+	if err := f.append(id, value); err != nil && f.err == nil {
+		f.err = err
+	}
+}
+
+// sync makes every record appended so far durable, so the WAL can
+// drop them, returns the first error found while writing if any
+func (f *File) sync() error {
+	f.Lock()
+	defer f.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	return f.file.Sync()
+}
+
+// append writes a new record at the end of the log and updates
+// the index, must be called while holding the lock.
+func (f *File) append(id int, value []byte) error {
+	record := encode(id, value)
+	if _, err := f.file.WriteAt(record, f.size); err != nil {
+		return fmt.Errorf("write id %d: %w", id, err)
+	}
+	f.index[id] = entry{offset: f.size + headerSize, length: len(value)}
+	f.size += int64(len(record))
+	return nil
+}
+
+// replay reads the whole log rebuilding the index, truncates the log
+// at the first torn record and returns the highest id found.
+func (f *File) replay() (int, error) {
+	info, err := f.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(f.file)
+	header := make([]byte, headerSize)
+	last := 0
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return 0, err
+		}
+		length := binary.BigEndian.Uint32(header[8:12])
+		// A torn header might claim more data than the log holds
+		if f.size+headerSize+int64(length) > info.Size() {
+			break
+		}
+		record := make([]byte, headerSize+int(length))
+		copy(record, header)
+		if _, err := io.ReadFull(reader, record[headerSize:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return 0, err
+		}
+		if binary.BigEndian.Uint32(header[12:16]) != checksum(record) {
+			break
+		}
+		id := int(binary.BigEndian.Uint64(header[0:8]))
+		f.index[id] = entry{offset: f.size + headerSize, length: int(length)}
+		f.size += int64(len(record))
+		if id > last {
+			last = id
+		}
+	}
+	// Drop anything after the last valid record (torn write)
+	if err := f.file.Truncate(f.size); err != nil {
+		return 0, err
+	}
+	return last, nil
+}
+
+// encode returns the record for id and value, header included
+func encode(id int, value []byte) []byte {
+	record := make([]byte, headerSize+len(value))
+	binary.BigEndian.PutUint64(record[0:8], uint64(id))
+	binary.BigEndian.PutUint32(record[8:12], uint32(len(value)))
+	copy(record[headerSize:], value)
+	binary.BigEndian.PutUint32(record[12:16], checksum(record))
+	return record
+}
+
+// checksum of a record ignoring its own checksum field
+func checksum(record []byte) uint32 {
+	crc := crc32.Update(0, crcTable, record[0:12])
+	return crc32.Update(crc, crcTable, record[headerSize:])
+}
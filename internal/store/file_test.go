@@ -0,0 +1,144 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Tests store for correct set/get ops
+func TestFileSetGet(t *testing.T) {
+	store, err := NewFile(t.TempDir(), 0)
+	equal(t, nil, err)
+	defer store.Close()
+	for i := 1; i <= 100; i++ {
+		input := []byte(fmt.Sprintf("%d", i))
+		index, err := store.Set(context.Background(), input)
+		equal(t, err, nil)
+		equal(t, index, i)
+		// Same as memory, wait for the write
+		equal(t, nil, store.Wait(context.Background(), index))
+		output, err := store.Get(context.Background(), i)
+		equal(t, err, nil)
+		equal(t, 0, bytes.Compare(input, output))
+	}
+}
+
+func TestFileDelay(t *testing.T) {
+	c := fake()
+	store, err := NewFile(t.TempDir(), 100*time.Millisecond, WithClock(c))
+	equal(t, nil, err)
+	defer store.Close()
+	input := []byte("test")
+	index, err := store.Set(context.Background(), input)
+	equal(t, err, nil)
+	equal(t, index, 1)
+	// Expect index not to be there yet
+	_, err = store.Get(context.Background(), index)
+	equal(t, true, errors.Is(err, ErrPending))
+	_, err = store.Get(context.Background(), index+1)
+	equal(t, ErrNotFound, err)
+	c.Advance(100 * time.Millisecond)
+	equal(t, nil, store.Wait(context.Background(), index))
+	output, err := store.Get(context.Background(), index)
+	equal(t, nil, err)
+	equal(t, 0, bytes.Compare(input, output))
+}
+
+// Close must flush pending writes and a new store on the
+// same directory must recover data and keep the counter
+func TestFileRecovery(t *testing.T) {
+	dir := t.TempDir()
+	c := fake()
+	store, err := NewFile(dir, 50*time.Millisecond, WithClock(c))
+	equal(t, nil, err)
+	for i := 1; i <= 10; i++ {
+		store.Set(context.Background(), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	closed := make(chan error)
+	go func() { closed <- store.Close() }()
+	c.Advance(50 * time.Millisecond)
+	equal(t, nil, <-closed)
+
+	store, err = NewFile(dir, 0)
+	equal(t, nil, err)
+	defer store.Close()
+	for i := 1; i <= 10; i++ {
+		output, err := store.Get(context.Background(), i)
+		equal(t, nil, err)
+		equal(t, fmt.Sprintf("value-%d", i), string(output))
+	}
+	index, err := store.Set(context.Background(), []byte("value-11"))
+	equal(t, nil, err)
+	equal(t, 11, index)
+}
+
+// Updates are appended and the last one wins on replay
+func TestFileUpdate(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFile(dir, 0)
+	equal(t, nil, err)
+	equal(t, ErrNotFound, store.Update(context.Background(), 1, []byte("new")))
+	index, _ := store.Set(context.Background(), []byte("old"))
+	store.Wait(context.Background(), index)
+	equal(t, nil, store.Update(context.Background(), index, []byte("new")))
+	output, _ := store.Get(context.Background(), index)
+	equal(t, "new", string(output))
+	equal(t, nil, store.Close())
+
+	store, err = NewFile(dir, 0)
+	equal(t, nil, err)
+	defer store.Close()
+	output, err = store.Get(context.Background(), index)
+	equal(t, nil, err)
+	equal(t, "new", string(output))
+}
+
+// A record torn by a crash mid-append is dropped and truncated
+func TestFileTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFile(dir, 0)
+	equal(t, nil, err)
+	store.Set(context.Background(), []byte("first"))
+	store.Set(context.Background(), []byte("second"))
+	equal(t, nil, store.Close())
+	// Chop the last bytes of the log to simulate the crash
+	path := filepath.Join(dir, FILE_NAME)
+	info, err := os.Stat(path)
+	equal(t, nil, err)
+	equal(t, nil, os.Truncate(path, info.Size()-3))
+
+	store, err = NewFile(dir, 0)
+	equal(t, nil, err)
+	defer store.Close()
+	// Either record might have landed first
+	found := 0
+	for i := 1; i <= 2; i++ {
+		if _, err := store.Get(context.Background(), i); err == nil {
+			found++
+		}
+	}
+	equal(t, 1, found)
+	// Log must end right after the surviving record
+	info, err = os.Stat(path)
+	equal(t, nil, err)
+	equal(t, store.size, info.Size())
+}
+
+// Closing again returns the same result, reads fail once closed
+func TestFileClose(t *testing.T) {
+	store, err := NewFile(t.TempDir(), 0)
+	equal(t, nil, err)
+	index, _ := store.Set(context.Background(), []byte("test"))
+	equal(t, nil, store.Close())
+	equal(t, nil, store.Close())
+	_, err = store.Get(context.Background(), index)
+	equal(t, ErrClosed, err)
+	_, err = store.Set(context.Background(), []byte("test"))
+	equal(t, ErrClosed, err)
+}
@@ -0,0 +1,75 @@
+package store
+
+import "sync/atomic"
+
+// Lifecycle states shared by the store, application and service layers
+const (
+	// Everything is allowed
+	STATE_OPEN State = iota
+	// Pending work is being finished, new writes are rejected
+	STATE_DRAINING
+	// Everything is rejected
+	STATE_CLOSED
+)
+
+// State of a Lifecycle, transitions only move forward
+type State int32
+
+func (s State) String() string {
+	switch s {
+	case STATE_OPEN:
+		return "open"
+	case STATE_DRAINING:
+		return "draining"
+	case STATE_CLOSED:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// Lifecycle is a state machine (open, draining, closed) safe for
+// concurrent use, the zero value is open. Transitions report if the
+// call made them, so tear down is only done once no matter how many
+// times Close is called.
+type Lifecycle struct {
+	state int32
+}
+
+// State returns the current state
+func (l *Lifecycle) State() State {
+	return State(atomic.LoadInt32(&l.state))
+}
+
+// Drain moves from open to draining, true if this call did it
+func (l *Lifecycle) Drain() bool {
+	return atomic.CompareAndSwapInt32(&l.state, int32(STATE_OPEN), int32(STATE_DRAINING))
+}
+
+// Close moves to closed from any state, true if this call did it
+func (l *Lifecycle) Close() bool {
+	for {
+		state := atomic.LoadInt32(&l.state)
+		if State(state) == STATE_CLOSED {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&l.state, state, int32(STATE_CLOSED)) {
+			return true
+		}
+	}
+}
+
+// Writable returns ErrClosed unless open
+func (l *Lifecycle) Writable() error {
+	if l.State() != STATE_OPEN {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Readable returns ErrClosed once closed
+func (l *Lifecycle) Readable() error {
+	if l.State() == STATE_CLOSED {
+		return ErrClosed
+	}
+	return nil
+}
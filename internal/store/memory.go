@@ -1,9 +1,8 @@
 package store
 
 import (
-	"errors"
+	"context"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
@@ -37,62 +36,120 @@ import (
 // go maps have O(1) amortized complexity for insert and lookups
 // on finite space domains (integer), making them performant.
 type Memory struct {
-	sync.WaitGroup
 	sync.RWMutex
-	count int64
-	data  map[int][]byte
-	delay time.Duration
+	data      map[int][]byte
+	scheduler *scheduler
 }
 
 // NewMemory creates a new store with 'delay' writes.
 // It is useful to allow the caller to setup the delay,
 // specially for testing as we avoid mocking.
-func NewMemory(delay time.Duration) *Memory {
-	return &Memory{
-		data:  make(map[int][]byte),
-		delay: delay,
-	}
+func NewMemory(delay time.Duration, options ...Option) *Memory {
+	m := &Memory{data: make(map[int][]byte)}
+	m.scheduler = newScheduler(delay, m.write, options...)
+	m.scheduler.replay(m.has)
+	return m
 }
 
-// Get returns the value at index id or an error otherwise
-func (m *Memory) Get(id int) ([]byte, error) {
+// Get returns the value at index id or an error otherwise,
+// ErrPending if the write is yet to be done or ErrNotFound.
+func (m *Memory) Get(ctx context.Context, id int) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := m.scheduler.state.Readable(); err != nil {
+		return nil, err
+	}
+	missing := m.scheduler.lookup(id)
 	// [FIX] Use the mutex to avoid reading on concurrent writes
 	m.Lock()
 	defer m.Unlock()
 	if val, ok := m.data[id]; ok {
 		return val, nil
 	}
-	return nil, errors.New("Not Found")
+	return nil, missing
 }
 
 // Set saves the value and returns the index where data will
-// be written after delay. It does not block but fires a
-// routine and keeps track of it via sync.WaitGroup, it uses
-// atomic increase on the index, and a sync.Mutex when writing
-// on a map for memory safety (concurrency).
-func (m *Memory) Set(value []byte) (int, error) {
-	// Atomically increment the counter to get a
-	// consistent index snapshot
-	index := atomic.AddInt64(&m.count, 1)
-	// For tracking pending writes
-	m.Add(1)
-	go func(key int64, val []byte) {
-		defer m.Done()
-		// Sleep(delay) as per the requirements
-		time.Sleep(m.delay)
-		// Lock during the write for memory safety
-		// due to concurrency (just in case)
-		m.Lock()
-		m.data[int(key)] = val
-		m.Unlock()
-	}(index, value)
-	return int(index), nil
+// be written after delay. It does not block, the write is
+// queued on the scheduler which keeps track of it and issues
+// the index, and a sync.Mutex is used when writing on a map
+// for memory safety (concurrency). Fails with ErrBackpressure
+// if there are too many pending writes (WithBackpressure).
+func (m *Memory) Set(ctx context.Context, value []byte) (int, error) {
+	return m.scheduler.schedule(ctx, value)
+}
+
+// Update replaces the value at index id if it was already written,
+// otherwise returns ErrPending or ErrNotFound like Get.
+func (m *Memory) Update(ctx context.Context, id int, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := m.scheduler.state.Writable(); err != nil {
+		return err
+	}
+	missing := m.scheduler.lookup(id)
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.data[id]; !ok {
+		return missing
+	}
+	if err := m.scheduler.log(id, value); err != nil {
+		return err
+	}
+	m.data[id] = value
+	return nil
+}
+
+// Wait blocks until the pending write of id is done or ctx is done
+func (m *Memory) Wait(ctx context.Context, id int) error {
+	return m.scheduler.wait(ctx, id)
+}
+
+// Observe registers fn to be notified of every write lifecycle event
+func (m *Memory) Observe(fn func(event string, id int)) {
+	m.scheduler.observe(fn)
+}
+
+// Len returns the number of values written
+func (m *Memory) Len() int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.data)
+}
+
+// Pending returns the number of writes waiting for delay
+func (m *Memory) Pending() int {
+	return m.scheduler.size()
 }
 
 // Close blocks until all pending write operations are done
 // Useful if data would be persisted, otherwise just a nice
 // "to have" in case other implementations are done.
+// New writes are rejected with ErrClosed as soon as Close is
+// called and reads once it is done, it is safe to call it again.
+// The WAL, if any, keeps every write as there is no other copy.
 func (m *Memory) Close() error {
-	m.Wait()
+	if m.scheduler.close() {
+		return m.scheduler.closeWAL(false)
+	}
 	return nil
 }
+
+// has tells if id was written, for the scheduler to replay the WAL
+func (m *Memory) has(id int) bool {
+	m.RLock()
+	defer m.RUnlock()
+	_, ok := m.data[id]
+	return ok
+}
+
+// write is called by the scheduler once delay has elapsed
+func (m *Memory) write(id int, value []byte) {
+	// Lock during the write for memory safety
+	// due to concurrency (just in case)
+	m.Lock()
+	m.data[id] = value
+	m.Unlock()
+}
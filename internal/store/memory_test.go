@@ -2,10 +2,16 @@ package store
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/phrozen/password-hash-exercise/internal/clock"
 )
 
 // WARNING: Don't use this, use testify instead!
@@ -19,20 +25,24 @@ func equal(t *testing.T, want, have any) {
 	}
 }
 
+// Fake clock for deterministic delays, it only moves with Advance
+func fake() *clock.Fake {
+	return clock.NewFake(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+}
+
 // Tests store for correct set/get ops
 func TestSetGet(t *testing.T) {
 	store := NewMemory(0)
 	defer store.Close()
 	for i := 1; i <= 100; i++ {
 		input := []byte(fmt.Sprintf("%d", i))
-		index, err := store.Set(input)
+		index, err := store.Set(context.Background(), input)
 		equal(t, err, nil)
 		equal(t, index, i)
-		// Even with 0 delay, scheduler needs time for
-		// context switching, 1ms should be enough
-		// but we use higher values for slow machines
-		time.Sleep(25 * time.Millisecond)
-		output, err := store.Get(i)
+		// Even with 0 delay, the write is done by the
+		// scheduler routine, wait for it instead of sleeping
+		equal(t, nil, store.Wait(context.Background(), index))
+		output, err := store.Get(context.Background(), i)
 		equal(t, err, nil)
 		equal(t, 0, bytes.Compare(input, output))
 	}
@@ -40,21 +50,340 @@ func TestSetGet(t *testing.T) {
 
 func TestDelay(t *testing.T) {
 	// Start with 100ms delay writes
-	store := NewMemory(100 * time.Millisecond)
+	c := fake()
+	store := NewMemory(100*time.Millisecond, WithClock(c))
 	defer store.Close()
 	input := []byte("test")
-	index, err := store.Set(input)
+	index, err := store.Set(context.Background(), input)
 	equal(t, err, nil)
 	equal(t, index, 1)
 	// Expect index not to be there yet
-	output, err := store.Get(index)
-	equal(t, true, err != nil)
+	output, err := store.Get(context.Background(), index)
+	equal(t, true, errors.Is(err, ErrPending))
 	equal(t, 0, bytes.Compare([]byte(nil), output))
-	// Wait more than delay...if it fails...
-	// try larger value on slow machines
-	time.Sleep(125 * time.Millisecond)
-	// Expect index to be there
-	output, err = store.Get(index)
+	// Reporting how long until the write is done
+	var pending *PendingError
+	equal(t, true, errors.As(err, &pending))
+	equal(t, index, pending.ID)
+	equal(t, 100*time.Millisecond, pending.Remaining)
+	c.Advance(40 * time.Millisecond)
+	_, err = store.Get(context.Background(), index)
+	equal(t, true, errors.As(err, &pending))
+	equal(t, 60*time.Millisecond, pending.Remaining)
+	// And the next one to not be issued at all
+	_, err = store.Get(context.Background(), index+1)
+	equal(t, ErrNotFound, err)
+	equal(t, 1, store.Pending())
+	equal(t, 0, store.Len())
+	// Once the delay is over, expect index to be there
+	c.Advance(60 * time.Millisecond)
+	equal(t, nil, store.Wait(context.Background(), index))
+	output, err = store.Get(context.Background(), index)
 	equal(t, nil, err)
 	equal(t, 0, bytes.Compare(input, output))
+	equal(t, 0, store.Pending())
+	equal(t, 1, store.Len())
+}
+
+func TestUpdate(t *testing.T) {
+	c := fake()
+	store := NewMemory(50*time.Millisecond, WithClock(c))
+	defer store.Close()
+	index, _ := store.Set(context.Background(), []byte("old"))
+	// Pending and unknown ids can't be updated
+	equal(t, true, errors.Is(store.Update(context.Background(), index, []byte("new")), ErrPending))
+	equal(t, ErrNotFound, store.Update(context.Background(), index+1, []byte("new")))
+	c.Advance(50 * time.Millisecond)
+	store.Wait(context.Background(), index)
+	equal(t, nil, store.Update(context.Background(), index, []byte("new")))
+	output, err := store.Get(context.Background(), index)
+	equal(t, nil, err)
+	equal(t, "new", string(output))
+}
+
+// Waiters must wake up as soon as the write is done
+func TestWait(t *testing.T) {
+	c := fake()
+	store := NewMemory(50*time.Millisecond, WithClock(c))
+	defer store.Close()
+	index, _ := store.Set(context.Background(), []byte("test"))
+	// Not issued and written ids return right away
+	equal(t, nil, store.Wait(context.Background(), index+1))
+	// Context done before the write
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	equal(t, context.Canceled, store.Wait(ctx, index))
+	// Many waiters for the same id
+	done := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			done <- store.Wait(context.Background(), index)
+		}()
+	}
+	c.Advance(50 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		equal(t, nil, <-done)
+	}
+	output, err := store.Get(context.Background(), index)
+	equal(t, nil, err)
+	equal(t, "test", string(output))
+	equal(t, nil, store.Wait(context.Background(), index))
+}
+
+// Observers get both lifecycle events in order
+func TestObserve(t *testing.T) {
+	store := NewMemory(0)
+	events := make(chan string, 2)
+	store.Observe(func(event string, id int) {
+		events <- fmt.Sprintf("%s %d", event, id)
+	})
+	store.Set(context.Background(), []byte("test"))
+	store.Close()
+	equal(t, "accepted 1", <-events)
+	equal(t, "persisted 1", <-events)
+}
+
+// Writes are applied in the order they are received, and
+// Close flushes every pending write before returning
+func TestOrder(t *testing.T) {
+	store := NewMemory(0)
+	persisted := make(chan int, 1000)
+	store.Observe(func(event string, id int) {
+		if event == EVENT_PERSISTED {
+			persisted <- id
+		}
+	})
+	for i := 0; i < 1000; i++ {
+		go store.Set(context.Background(), []byte("test"))
+	}
+	for i := 1; i <= 1000; i++ {
+		equal(t, i, <-persisted)
+	}
+	// Scheduler starts again after it is drained
+	index, _ := store.Set(context.Background(), []byte("again"))
+	equal(t, nil, store.Wait(context.Background(), index))
+	output, err := store.Get(context.Background(), index)
+	equal(t, nil, err)
+	equal(t, "again", string(output))
+	store.Set(context.Background(), []byte("last"))
+	store.Close()
+	equal(t, 1002, store.Len())
+	equal(t, 0, store.Pending())
+	// No more writes are taken once closed
+	_, err = store.Set(context.Background(), []byte("closed"))
+	equal(t, ErrClosed, err)
+}
+
+// sleepingMemory keeps the previous design of Memory writes for
+// comparison: one goroutine per write sleeping for delay.
+type sleepingMemory struct {
+	sync.WaitGroup
+	sync.Mutex
+	count int64
+	data  map[int][]byte
+}
+
+func (m *sleepingMemory) Set(value []byte, delay time.Duration) int {
+	index := int(atomic.AddInt64(&m.count, 1))
+	m.Add(1)
+	go func() {
+		defer m.Done()
+		time.Sleep(delay)
+		m.Lock()
+		m.data[index] = value
+		m.Unlock()
+	}()
+	return index
+}
+
+// Goroutines alive after b.N writes pending on both designs,
+// run with -benchmem and compare goroutines/op and B/op.
+func BenchmarkSetScheduler(b *testing.B) {
+	store := NewMemory(time.Second)
+	value := []byte("test")
+	goroutines := runtime.NumGoroutine()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.Set(context.Background(), value)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(runtime.NumGoroutine()-goroutines), "goroutines")
+	store.Close()
+}
+
+func BenchmarkSetGoroutines(b *testing.B) {
+	store := &sleepingMemory{data: make(map[int][]byte)}
+	value := []byte("test")
+	goroutines := runtime.NumGoroutine()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.Set(value, time.Second)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(runtime.NumGoroutine()-goroutines), "goroutines")
+	store.Wait()
+}
+
+// Set fails fast or blocks for room once max pending writes is reached
+func TestBackpressure(t *testing.T) {
+	c := fake()
+	store := NewMemory(50*time.Millisecond, WithBackpressure(2, 0), WithClock(c))
+	defer store.Close()
+	store.Set(context.Background(), []byte("1"))
+	c.Advance(20 * time.Millisecond)
+	store.Set(context.Background(), []byte("2"))
+	// Fails fast even if the context could be waited on
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := store.Set(ctx, []byte("3"))
+	equal(t, true, errors.Is(err, ErrBackpressure))
+	var full *BackpressureError
+	equal(t, true, errors.As(err, &full))
+	equal(t, 2, full.Max)
+	// Room for a new write once the first one is done
+	equal(t, 30*time.Millisecond, full.RetryAfter)
+	equal(t, 2, store.Pending())
+	c.Advance(50 * time.Millisecond)
+	store.Wait(context.Background(), 2)
+	// Blocks until the first write is done, ids are not wasted on failures
+	c = fake()
+	blocking := NewMemory(50*time.Millisecond, WithBackpressure(1, time.Minute), WithClock(c))
+	defer blocking.Close()
+	blocking.Set(context.Background(), []byte("1"))
+	done := make(chan int)
+	go func() {
+		index, _ := blocking.Set(context.Background(), []byte("2"))
+		done <- index
+	}()
+	c.Advance(50 * time.Millisecond)
+	equal(t, 2, <-done)
+	c.Advance(50 * time.Millisecond)
+	// Fails once the wait is over on the clock
+	c = fake()
+	waiting := NewMemory(time.Hour, WithBackpressure(1, time.Minute), WithClock(c))
+	defer waiting.Close()
+	defer c.Advance(time.Hour)
+	waiting.Set(context.Background(), []byte("1"))
+	failed := make(chan error)
+	go func() {
+		_, err := waiting.Set(context.Background(), []byte("2"))
+		failed <- err
+	}()
+	// Both the write and the wait are on the clock
+	c.BlockUntil(2)
+	c.Advance(time.Minute)
+	err = <-failed
+	equal(t, true, errors.As(err, &full))
+	equal(t, 59*time.Minute, full.RetryAfter)
+}
+
+// Done contexts fail right away without issuing ids
+func TestCancel(t *testing.T) {
+	store := NewMemory(0, WithBackpressure(1, time.Second))
+	defer store.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := store.Set(ctx, []byte("test"))
+	equal(t, context.Canceled, err)
+	index, _ := store.Set(context.Background(), []byte("test"))
+	equal(t, 1, index)
+	store.Wait(context.Background(), index)
+	_, err = store.Get(ctx, index)
+	equal(t, context.Canceled, err)
+	equal(t, context.Canceled, store.Update(ctx, index, []byte("new")))
+	// Deadlines cut short the wait for room, failing with their error
+	c := fake()
+	full := NewMemory(time.Second, WithBackpressure(1, time.Minute), WithClock(c))
+	defer full.Close()
+	full.Set(context.Background(), []byte("test"))
+	ctx, cancel = clock.WithTimeout(context.Background(), c, time.Millisecond)
+	defer cancel()
+	failed := make(chan error)
+	go func() {
+		_, err := full.Set(ctx, []byte("test"))
+		failed <- err
+	}()
+	// The write, the deadline and the wait for room
+	c.BlockUntil(3)
+	c.Advance(time.Millisecond)
+	err = <-failed
+	equal(t, ctx.Err(), err)
+	equal(t, false, errors.Is(err, ErrBackpressure))
+	equal(t, 1, full.Pending())
+	c.Advance(time.Second)
+}
+
+// Callers without a context keep working through the adapter
+func TestBackground(t *testing.T) {
+	store := NewBackground(NewMemory(0))
+	defer store.Close()
+	index, err := store.Set([]byte("old"))
+	equal(t, nil, err)
+	equal(t, nil, store.Wait(context.Background(), index))
+	equal(t, nil, store.Update(index, []byte("new")))
+	output, err := store.Get(index)
+	equal(t, nil, err)
+	equal(t, "new", string(output))
+}
+
+// Writes racing with Close are either persisted or rejected with
+// ErrClosed, run with -race to catch misuses of the sync.WaitGroup
+func TestClose(t *testing.T) {
+	c := fake()
+	store := NewMemory(10*time.Millisecond, WithClock(c))
+	index, _ := store.Set(context.Background(), []byte("test"))
+	var accepted int64
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := store.Set(context.Background(), []byte("test"))
+			if err == nil {
+				atomic.AddInt64(&accepted, 1)
+				return
+			}
+			if err != ErrClosed {
+				t.Error(err)
+			}
+		}()
+	}
+	// Writes are rejected while draining
+	closed := make(chan error)
+	go func() { closed <- store.Close() }()
+	for store.scheduler.state.State() == STATE_OPEN {
+		runtime.Gosched()
+	}
+	_, err := store.Set(context.Background(), []byte("test"))
+	equal(t, ErrClosed, err)
+	equal(t, ErrClosed, store.Update(context.Background(), index, []byte("new")))
+	// Every write racing with Close is either accepted or rejected by
+	// now, the accepted ones are flushed once the delay is over
+	wg.Wait()
+	c.Advance(10 * time.Millisecond)
+	equal(t, nil, <-closed)
+	equal(t, int(accepted)+1, store.Len())
+	equal(t, 0, store.Pending())
+	// Reads are rejected once closed, and closing again is safe
+	_, err = store.Get(context.Background(), index)
+	equal(t, ErrClosed, err)
+	equal(t, nil, store.Close())
+	equal(t, STATE_CLOSED, store.scheduler.state.State())
+}
+
+func TestLifecycle(t *testing.T) {
+	l := &Lifecycle{}
+	equal(t, STATE_OPEN, l.State())
+	equal(t, nil, l.Writable())
+	equal(t, true, l.Drain())
+	equal(t, false, l.Drain())
+	equal(t, "draining", l.State().String())
+	equal(t, ErrClosed, l.Writable())
+	equal(t, nil, l.Readable())
+	equal(t, true, l.Close())
+	equal(t, false, l.Close())
+	equal(t, ErrClosed, l.Readable())
+	equal(t, "closed", l.State().String())
 }
@@ -0,0 +1,483 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/phrozen/password-hash-exercise/internal/clock"
+)
+
+// scheduler provides the delayed write semantics shared by every Store
+// implementation: ids are handed out in autoincrement fashion as soon as
+// a value is received, and the actual write is done by the apply function
+// once delay has elapsed. Keeping it in a single place guarantees all the
+// backends behave the same way from the application's point of view.
+//
+// As the delay is fixed, writes are due in the same order they are
+// received, so a FIFO queue drained by a single timer driven routine is
+// enough (no heap needed). The routine only runs while there are writes
+// pending and is tracked on the sync.WaitGroup, so they can be flushed.
+// The number of pending writes can be bounded with max, to protect the
+// memory from bursts (backpressure). Writes are rejected with ErrClosed
+// as soon as close starts draining the pending ones. Accepted writes
+// are logged on the WAL if any, before Set returns, and the writes
+// replayed from it are kept until the first Set, to be applied again
+// on top of a restored snapshot. Stores whose applied writes are durable
+// set durable, so the WAL is checkpointed as writes are applied. Writes
+// due at the same time are applied together, stores that can do them at
+// once (a single transaction) set batch, otherwise apply is called for
+// each of them.
+type scheduler struct {
+	sync.WaitGroup
+	sync.Mutex
+	count     int64
+	clock     clock.Clock
+	delay     time.Duration
+	apply     func(id int, value []byte)
+	batch     func(writes []write)
+	max       int
+	timeout   time.Duration
+	freed     chan struct{}
+	queue     []write
+	running   bool
+	state     Lifecycle
+	wal       *WAL
+	durable   func() error
+	replayed  []walEntry
+	fresh     bool
+	pending   map[int]time.Time
+	waiters   map[int]chan struct{}
+	observers []func(string, int)
+}
+
+// write is a value waiting in the queue until due, seq is its record
+// on the WAL (if any) which must be committed before it is applied.
+// accepted is closed once Set is done with it, persisted is held back
+// until then, so observers always get the events in order.
+type write struct {
+	id       int
+	value    []byte
+	due      time.Time
+	seq      uint64
+	accepted chan struct{}
+}
+
+// newScheduler creates a scheduler that calls apply after delay
+func newScheduler(delay time.Duration, apply func(int, []byte), options ...Option) *scheduler {
+	s := &scheduler{
+		clock:   clock.Real{},
+		delay:   delay,
+		apply:   apply,
+		fresh:   true,
+		pending: make(map[int]time.Time),
+		waiters: make(map[int]chan struct{}),
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// schedule reserves the next id for value and queues the write to be
+// applied after delay, starting the routine that drains the queue if
+// it is not running already. Fails with a *BackpressureError if there
+// is no room for another pending write in time, or with the error of
+// ctx if it is done while waiting for room. With a WAL,
+// returns once the write is logged as per its SyncPolicy, if logging
+// fails the write is dropped (never applied) and the error is returned.
+func (s *scheduler) schedule(ctx context.Context, value []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.Lock()
+	if err := s.reserve(ctx); err != nil {
+		s.Unlock()
+		return 0, err
+	}
+	// Ids are issued under the lock, so the queue
+	// is always sorted by both id and due time
+	s.fresh = false
+	s.replayed = nil
+	s.count++
+	index := int(s.count)
+	due := s.clock.Now().Add(s.delay)
+	// Logged in id order, committed without the lock (group commit)
+	seq := uint64(0)
+	if s.wal != nil {
+		seq = s.wal.append(walSet, index, value)
+	}
+	accepted := make(chan struct{})
+	s.queue = append(s.queue, write{index, value, due, seq, accepted})
+	// Keep track of when the write is due
+	s.pending[index] = due
+	if !s.running {
+		s.running = true
+		s.Add(1)
+		go s.run()
+	}
+	s.Unlock()
+	// The write might be applied before it is logged (zero delay)
+	defer close(accepted)
+	if s.wal != nil {
+		if err := s.wal.commit(seq); err != nil {
+			s.drop(index)
+			return 0, err
+		}
+	}
+	s.notify(EVENT_ACCEPTED, index)
+	return index, nil
+}
+
+// reserve blocks until there is room for a pending write, the wait
+// (WithBackpressure) is over or ctx is done (failing with its error),
+// without a wait it fails right away no matter the context.
+// Must be called with the lock held, which is released while blocking.
+// The state is checked under the lock, so the sync.WaitGroup is never
+// increased once close is waiting on it.
+func (s *scheduler) reserve(ctx context.Context) error {
+	// Created on the first wait, the wait is bounded as a whole
+	var timer clock.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for {
+		if err := s.state.Writable(); err != nil {
+			return err
+		}
+		if s.max <= 0 || len(s.pending) < s.max {
+			return nil
+		}
+		if s.timeout <= 0 {
+			return s.full()
+		}
+		// Shared by everyone blocked, closed on the next write done
+		if s.freed == nil {
+			s.freed = make(chan struct{})
+		}
+		freed := s.freed
+		if timer == nil {
+			timer = s.clock.NewTimer(s.clock.Now().Add(s.timeout))
+		}
+		s.Unlock()
+		select {
+		case <-freed:
+			s.Lock()
+		case <-timer.C():
+			s.Lock()
+			return s.full()
+		case <-ctx.Done():
+			s.Lock()
+			return ctx.Err()
+		}
+	}
+}
+
+// full returns the backpressure error, must be called with the lock
+// held. The queue might be empty if the writes were done while waiting.
+func (s *scheduler) full() error {
+	retry := time.Duration(0)
+	if len(s.queue) > 0 {
+		retry = s.queue[0].due.Sub(s.clock.Now())
+	}
+	if retry < 0 {
+		retry = 0
+	}
+	return &BackpressureError{Max: s.max, RetryAfter: retry}
+}
+
+// run applies every queued write once it is due, in order, and
+// returns as soon as the queue is empty.
+func (s *scheduler) run() {
+	defer s.Done()
+	// Reused for every write, created on first use
+	var timer clock.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for {
+		s.Lock()
+		if len(s.queue) == 0 {
+			s.running = false
+			// Release the backing array while idle
+			s.queue = nil
+			s.Unlock()
+			return
+		}
+		// Only this routine removes the head of the queue
+		next := s.queue[0]
+		s.Unlock()
+		// Writes that failed to be logged are never applied, the
+		// commit returns right away if the record is already logged
+		if s.wal != nil && s.wal.commit(next.seq) != nil {
+			s.Lock()
+			s.queue[0] = write{}
+			s.queue = s.queue[1:]
+			s.finish(next.id)
+			s.Unlock()
+			continue
+		}
+		if next.due.After(s.clock.Now()) {
+			// Sleep(delay) as per the requirements
+			if timer == nil {
+				timer = s.clock.NewTimer(next.due)
+			} else {
+				timer.Reset(next.due)
+			}
+			<-timer.C()
+		}
+		// Every write due by now goes with it, only if they are logged
+		s.Lock()
+		now := s.clock.Now()
+		n := 1
+		for n < len(s.queue) && !s.queue[n].due.After(now) {
+			n++
+		}
+		writes := append([]write(nil), s.queue[:n]...)
+		s.Unlock()
+		if n > 1 && s.wal != nil && s.wal.commit(writes[n-1].seq) != nil {
+			writes, n = writes[:1], 1
+		}
+		s.applyAll(writes)
+		// Only after the writes are visible, so readers never
+		// find an id missing from both places
+		s.Lock()
+		for i := 0; i < n; i++ {
+			s.queue[i] = write{}
+		}
+		s.queue = s.queue[n:]
+		// Every record before the next write in the queue is applied
+		seq := writes[n-1].seq
+		if len(s.queue) > 0 {
+			seq = s.queue[0].seq - 1
+		} else if s.wal != nil {
+			seq = s.wal.last()
+		}
+		s.Unlock()
+		s.checkpoint(seq)
+		s.Lock()
+		for _, w := range writes {
+			s.finish(w.id)
+		}
+		s.Unlock()
+		for _, w := range writes {
+			<-w.accepted
+			s.notify(EVENT_PERSISTED, w.id)
+		}
+	}
+}
+
+// applyAll applies the writes in order, at once if the store batches them
+func (s *scheduler) applyAll(writes []write) {
+	if s.batch != nil {
+		s.batch(writes)
+		return
+	}
+	for _, w := range writes {
+		s.apply(w.id, w.value)
+	}
+}
+
+// checkpoint drops the records up to seq from the WAL once it grows past
+// its limit, if the store made the writes applied so far durable. Updates
+// are logged and done under the store lock, which durable takes, so they
+// are done by then. There is no caller to report errors to, so they are
+// recorded as sticky on the WAL (making the next Set fail) whether the
+// store failed to make its writes durable or the WAL to be replaced.
+func (s *scheduler) checkpoint(seq uint64) {
+	if s.wal == nil || s.durable == nil || !s.wal.full() {
+		return
+	}
+	if err := s.durable(); err != nil {
+		s.wal.Lock()
+		s.wal.fail(err)
+		s.wal.Unlock()
+		return
+	}
+	// Sticky on its own
+	s.wal.checkpoint(seq)
+}
+
+// finish releases the slot of a write no longer pending, applied or
+// dropped, must be called with the lock held.
+func (s *scheduler) finish(id int) {
+	delete(s.pending, id)
+	// Wake up everyone waiting for this write
+	if ch, ok := s.waiters[id]; ok {
+		close(ch)
+		delete(s.waiters, id)
+	}
+	// Wake up everyone blocked for room
+	if s.freed != nil {
+		close(s.freed)
+		s.freed = nil
+	}
+}
+
+// drop takes a write that failed to be logged out of the queue and
+// releases its slot right away. The head of the queue is left to run,
+// which might be waiting for it and drops it as its commit fails too.
+func (s *scheduler) drop(id int) {
+	s.Lock()
+	defer s.Unlock()
+	i := sort.Search(len(s.queue), func(i int) bool { return s.queue[i].id >= id })
+	if i == 0 || i == len(s.queue) || s.queue[i].id != id {
+		return
+	}
+	copy(s.queue[i:], s.queue[i+1:])
+	s.queue[len(s.queue)-1] = write{}
+	s.queue = s.queue[:len(s.queue)-1]
+	s.finish(id)
+}
+
+// lookup returns the error for an id missing from the store, a store
+// must check it BEFORE looking for the id in its own data, as pending
+// is cleared right after the write is done. Pending ids report the
+// remaining time for the write with a *PendingError.
+func (s *scheduler) lookup(id int) error {
+	s.Lock()
+	defer s.Unlock()
+	if due, ok := s.pending[id]; ok {
+		remaining := due.Sub(s.clock.Now())
+		// Write is overdue but still in progress
+		if remaining < 0 {
+			remaining = 0
+		}
+		return &PendingError{ID: id, Remaining: remaining}
+	}
+	return ErrNotFound
+}
+
+// wait blocks until the pending write of id is done or ctx is done, waiters
+// share a single channel per id that is closed right after the write.
+func (s *scheduler) wait(ctx context.Context, id int) error {
+	s.Lock()
+	if _, ok := s.pending[id]; !ok {
+		s.Unlock()
+		return nil
+	}
+	ch, ok := s.waiters[id]
+	if !ok {
+		ch = make(chan struct{})
+		s.waiters[id] = ch
+	}
+	s.Unlock()
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// size returns the number of pending writes
+func (s *scheduler) size() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.pending)
+}
+
+// observe registers fn to be notified of every write lifecycle event
+func (s *scheduler) observe(fn func(string, int)) {
+	s.Lock()
+	defer s.Unlock()
+	s.observers = append(s.observers, fn)
+}
+
+// notify calls every observer outside the lock, so they can
+// safely call back into the store if needed.
+func (s *scheduler) notify(event string, id int) {
+	s.Lock()
+	observers := s.observers
+	s.Unlock()
+	for _, fn := range observers {
+		fn(event, id)
+	}
+}
+
+// log writes the update of an id on the WAL if any, stores must call
+// it before doing the update, as it is lost on a crash otherwise.
+func (s *scheduler) log(id int, value []byte) error {
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.commit(s.wal.append(walUpdate, id, value))
+}
+
+// replay applies the writes logged on the WAL that the store is missing,
+// those whose id has tells is not in the store, and moves the counter
+// past them. Updates are applied again in the order they were done. Must
+// be called by stores once their own data is recovered, before any Set.
+func (s *scheduler) replay(has func(id int) bool) {
+	if s.wal == nil {
+		return
+	}
+	s.replayed = s.wal.recovered()
+	s.count = redo(s.replayed, s.count, has, s.apply)
+}
+
+// restore moves the counter to the one of a restored snapshot, applying
+// the writes replayed from the WAL again on top of it with apply, so
+// only the ones missing from the snapshot (has) are kept. Fails with
+// ErrNotEmpty once Set issued an id or a snapshot was restored already.
+// Must be called with the lock held.
+func (s *scheduler) restore(counter int64, has func(int) bool, apply func(int, []byte)) error {
+	if !s.fresh {
+		return ErrNotEmpty
+	}
+	s.fresh = false
+	s.count = redo(s.replayed, counter, has, apply)
+	s.replayed = nil
+	return nil
+}
+
+// redo applies the WAL entries missing from the store (and every update)
+// and returns the counter moved past them. The counter alone can't tell,
+// a write the store failed to apply is older than the ones after it.
+func redo(entries []walEntry, counter int64, has func(int) bool, apply func(int, []byte)) int64 {
+	for _, entry := range entries {
+		if entry.kind == walUpdate {
+			apply(entry.id, entry.value)
+			continue
+		}
+		if !has(entry.id) {
+			apply(entry.id, entry.value)
+		}
+		if int64(entry.id) > counter {
+			counter = int64(entry.id)
+		}
+	}
+	return counter
+}
+
+// closeWAL closes the WAL if any, stores whose applied writes are
+// durable on their own checkpoint it first (empty it), otherwise
+// it keeps every write to be replayed on the next run.
+func (s *scheduler) closeWAL(checkpoint bool) error {
+	if s.wal == nil {
+		return nil
+	}
+	if checkpoint {
+		if err := s.wal.Truncate(); err != nil {
+			s.wal.Close()
+			return err
+		}
+	}
+	return s.wal.Close()
+}
+
+// close stops taking writes (draining) and blocks until all pending
+// writes are applied, it is safe to call many times and returns true
+// only for the call that moved the state to closed.
+func (s *scheduler) close() bool {
+	s.Lock()
+	s.state.Drain()
+	s.Unlock()
+	s.Wait()
+	return s.state.Close()
+}
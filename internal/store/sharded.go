@@ -0,0 +1,160 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Number of shards, must be a power of 2 so ids are
+// partitioned with a mask instead of a modulo.
+const SHARD_COUNT = 64
+
+// shard is a lock protected partition of the data, padded to a cache
+// line so locking a shard does not invalidate its neighbours (false
+// sharing) under heavy parallel load.
+type shard struct {
+	sync.RWMutex
+	data map[int][]byte
+	_    [32]byte
+}
+
+// Sharded implements the same in-memory store as Memory, but ids are
+// partitioned across SHARD_COUNT maps with their own sync.RWMutex, so
+// reads only take a read lock on a single shard and writes landing
+// only contend with reads of the same shard. As ids are autoincrement,
+// consecutive ids land on different shards spreading the load evenly.
+// Reads of written ids don't touch the scheduler at all, pending writes
+// are only looked up when the id is missing from its shard.
+type Sharded struct {
+	shards    [SHARD_COUNT]shard
+	size      int64
+	scheduler *scheduler
+}
+
+// NewSharded creates a new sharded store with 'delay' writes
+func NewSharded(delay time.Duration, options ...Option) *Sharded {
+	s := &Sharded{}
+	for i := range s.shards {
+		s.shards[i].data = make(map[int][]byte)
+	}
+	s.scheduler = newScheduler(delay, s.write, options...)
+	s.scheduler.replay(s.has)
+	return s
+}
+
+// shard returns the partition for id
+func (s *Sharded) shard(id int) *shard {
+	return &s.shards[uint(id)&(SHARD_COUNT-1)]
+}
+
+// read returns the value at id from its shard under a read lock
+func (s *Sharded) read(id int) ([]byte, bool) {
+	sh := s.shard(id)
+	sh.RLock()
+	defer sh.RUnlock()
+	val, ok := sh.data[id]
+	return val, ok
+}
+
+// Get returns the value at index id or an error otherwise,
+// ErrPending if the write is yet to be done or ErrNotFound.
+func (s *Sharded) Get(ctx context.Context, id int) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := s.scheduler.state.Readable(); err != nil {
+		return nil, err
+	}
+	if val, ok := s.read(id); ok {
+		return val, nil
+	}
+	missing := s.scheduler.lookup(id)
+	if errors.Is(missing, ErrNotFound) {
+		// The write might have landed right after the first read
+		// as pending is cleared after the write, check once more
+		if val, ok := s.read(id); ok {
+			return val, nil
+		}
+	}
+	return nil, missing
+}
+
+// Set saves the value and returns the index where data will
+// be written after delay, it does not block (see Memory.Set).
+func (s *Sharded) Set(ctx context.Context, value []byte) (int, error) {
+	return s.scheduler.schedule(ctx, value)
+}
+
+// Update replaces the value at index id if it was already written,
+// otherwise returns ErrPending or ErrNotFound like Get.
+func (s *Sharded) Update(ctx context.Context, id int, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := s.scheduler.state.Writable(); err != nil {
+		return err
+	}
+	missing := s.scheduler.lookup(id)
+	sh := s.shard(id)
+	sh.Lock()
+	defer sh.Unlock()
+	if _, ok := sh.data[id]; !ok {
+		return missing
+	}
+	if err := s.scheduler.log(id, value); err != nil {
+		return err
+	}
+	sh.data[id] = value
+	return nil
+}
+
+// Wait blocks until the pending write of id is done or ctx is done
+func (s *Sharded) Wait(ctx context.Context, id int) error {
+	return s.scheduler.wait(ctx, id)
+}
+
+// Observe registers fn to be notified of every write lifecycle event
+func (s *Sharded) Observe(fn func(event string, id int)) {
+	s.scheduler.observe(fn)
+}
+
+// Len returns the number of values written
+func (s *Sharded) Len() int {
+	return int(atomic.LoadInt64(&s.size))
+}
+
+// Pending returns the number of writes waiting for delay
+func (s *Sharded) Pending() int {
+	return s.scheduler.size()
+}
+
+// Close blocks until all pending write operations are done,
+// it behaves just like Memory.Close
+func (s *Sharded) Close() error {
+	if s.scheduler.close() {
+		return s.scheduler.closeWAL(false)
+	}
+	return nil
+}
+
+// has tells if id was written, for the scheduler to replay the WAL
+func (s *Sharded) has(id int) bool {
+	_, ok := s.read(id)
+	return ok
+}
+
+// write is called by the scheduler once delay has elapsed, and for
+// every write and update replayed from the WAL, only new ids count.
+func (s *Sharded) write(id int, value []byte) {
+	sh := s.shard(id)
+	sh.Lock()
+	_, ok := sh.data[id]
+	sh.data[id] = value
+	sh.Unlock()
+	if !ok {
+		atomic.AddInt64(&s.size, 1)
+	}
+}
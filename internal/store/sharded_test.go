@@ -0,0 +1,98 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Tests store for correct set/get ops
+func TestShardedSetGet(t *testing.T) {
+	store := NewSharded(0)
+	defer store.Close()
+	for i := 1; i <= 2*SHARD_COUNT; i++ {
+		input := []byte(fmt.Sprintf("%d", i))
+		index, err := store.Set(context.Background(), input)
+		equal(t, err, nil)
+		equal(t, index, i)
+		equal(t, nil, store.Wait(context.Background(), index))
+		output, err := store.Get(context.Background(), i)
+		equal(t, err, nil)
+		equal(t, 0, bytes.Compare(input, output))
+	}
+	equal(t, 2*SHARD_COUNT, store.Len())
+	// Every shard got the same number of ids
+	for i := range store.shards {
+		equal(t, 2, len(store.shards[i].data))
+	}
+}
+
+func TestShardedDelay(t *testing.T) {
+	c := fake()
+	store := NewSharded(50*time.Millisecond, WithClock(c))
+	defer store.Close()
+	index, _ := store.Set(context.Background(), []byte("test"))
+	_, err := store.Get(context.Background(), index)
+	equal(t, true, errors.Is(err, ErrPending))
+	_, err = store.Get(context.Background(), index+1)
+	equal(t, ErrNotFound, err)
+	equal(t, 1, store.Pending())
+	equal(t, 0, store.Len())
+	// Pending and unknown ids can't be updated
+	equal(t, true, errors.Is(store.Update(context.Background(), index, []byte("new")), ErrPending))
+	equal(t, ErrNotFound, store.Update(context.Background(), index+1, []byte("new")))
+	c.Advance(50 * time.Millisecond)
+	equal(t, nil, store.Wait(context.Background(), index))
+	equal(t, nil, store.Update(context.Background(), index, []byte("new")))
+	output, err := store.Get(context.Background(), index)
+	equal(t, nil, err)
+	equal(t, "new", string(output))
+	equal(t, 0, store.Pending())
+	equal(t, 1, store.Len())
+}
+
+// Reads of written ids while writes keep landing, run with -cpu 1,8,32
+// to compare how both stores scale with the number of cores
+func benchmarkGetParallel(b *testing.B, store Store) {
+	for i := 0; i < 10000; i++ {
+		store.Set(context.Background(), []byte("test"))
+	}
+	store.Wait(context.Background(), 10000)
+	// Writes landing in the background
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				store.Set(context.Background(), []byte("test"))
+			}
+		}
+	}()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		id := 1
+		for pb.Next() {
+			store.Get(context.Background(), id)
+			id = id%10000 + 1
+		}
+	})
+	b.StopTimer()
+	close(done)
+	<-stopped
+	store.Close()
+}
+
+func BenchmarkGetParallelMemory(b *testing.B) {
+	benchmarkGetParallel(b, NewMemory(0))
+}
+
+func BenchmarkGetParallelSharded(b *testing.B) {
+	benchmarkGetParallel(b, NewSharded(0))
+}
@@ -0,0 +1,269 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Snapshots are written in a versioned binary format:
+//   - magic "PHSS" (4 bytes) and version (uint32)
+//   - id counter (uint64) and number of values (uint64)
+//   - every value as id (uint64), length (uint32) and the value itself
+//   - CRC32 (Castagnoli) of everything above (uint32)
+//
+// Versions are bumped on any change, so old binaries refuse snapshots
+// they can't read instead of restoring garbage.
+const (
+	SNAPSHOT_MAGIC   = "PHSS"
+	SNAPSHOT_VERSION = 1
+)
+
+var (
+	// ErrSnapshot is returned when restoring a snapshot that is
+	// truncated, corrupt or written in an unknown version.
+	ErrSnapshot = errors.New("Invalid Snapshot")
+	// ErrNotEmpty is returned when restoring a store that issued
+	// ids with Set or was restored, restore must be done on startup.
+	ErrNotEmpty = errors.New("Not Empty")
+)
+
+// Snapshotter is implemented by stores that can checkpoint their data
+type Snapshotter interface {
+	Snapshot(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+// checkpointer is implemented by snapshotters that can drop the records
+// a saved snapshot covers from their WAL, snapshot returns the last one
+type checkpointer interface {
+	snapshot(w io.Writer) (uint64, error)
+	checkpoint(seq uint64) error
+}
+
+// Snapshot writes every value written so far along with the id counter
+// to w, it is safe to call concurrently with other operations and even
+// after Close (a final checkpoint). Pending writes are part of it as if
+// they were written already, so every id issued is found after a restore.
+func (m *Memory) Snapshot(w io.Writer) error {
+	_, err := m.snapshot(w)
+	return err
+}
+
+// snapshot writes the snapshot to w and returns the last WAL record
+// it covers, updates are logged under the lock so they are done too
+func (m *Memory) snapshot(w io.Writer) (uint64, error) {
+	// Values are replaced and never modified, so references are
+	// copied under the locks and written to w without holding them
+	m.Lock()
+	data := make(map[int][]byte, len(m.data))
+	for id, value := range m.data {
+		data[id] = value
+	}
+	m.scheduler.Lock()
+	counter := m.scheduler.count
+	seq := uint64(0)
+	if m.scheduler.wal != nil {
+		seq = m.scheduler.wal.last()
+	}
+	for _, write := range m.scheduler.queue {
+		// Written but not out of the queue yet, might be updated
+		if _, ok := data[write.id]; !ok {
+			data[write.id] = write.value
+		}
+	}
+	m.scheduler.Unlock()
+	m.Unlock()
+	return seq, writeSnapshot(w, counter, data)
+}
+
+// checkpoint drops the records covered by a saved snapshot from the WAL
+func (m *Memory) checkpoint(seq uint64) error {
+	if m.scheduler.wal == nil {
+		return nil
+	}
+	return m.scheduler.wal.checkpoint(seq)
+}
+
+// Restore replaces the data and the id counter with the snapshot read from
+// r, the writes replayed from the WAL (if any) newer than the snapshot are
+// applied on top of it. Fails with ErrNotEmpty if the store issued ids
+// with Set or was restored already and with ErrSnapshot if the snapshot
+// is not valid (nothing is restored then).
+func (m *Memory) Restore(r io.Reader) error {
+	counter, data, err := readSnapshot(r)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.scheduler.Lock()
+	defer m.scheduler.Unlock()
+	has := func(id int) bool {
+		_, ok := data[id]
+		return ok
+	}
+	err = m.scheduler.restore(counter, has, func(id int, value []byte) {
+		data[id] = value
+	})
+	if err != nil {
+		return err
+	}
+	m.data = data
+	return nil
+}
+
+// writeSnapshot encodes the counter and data into w, sorted by id
+func writeSnapshot(w io.Writer, counter int64, data map[int][]byte) error {
+	ids := make([]int, 0, len(data))
+	for id := range data {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	buffer := bufio.NewWriter(w)
+	crc := crc32.New(crcTable)
+	out := io.MultiWriter(buffer, crc)
+	header := make([]byte, 4+4+8+8)
+	copy(header[0:4], SNAPSHOT_MAGIC)
+	binary.BigEndian.PutUint32(header[4:8], SNAPSHOT_VERSION)
+	binary.BigEndian.PutUint64(header[8:16], uint64(counter))
+	binary.BigEndian.PutUint64(header[16:24], uint64(len(ids)))
+	if _, err := out.Write(header); err != nil {
+		return err
+	}
+	record := make([]byte, 8+4)
+	for _, id := range ids {
+		binary.BigEndian.PutUint64(record[0:8], uint64(id))
+		binary.BigEndian.PutUint32(record[8:12], uint32(len(data[id])))
+		if _, err := out.Write(record); err != nil {
+			return err
+		}
+		if _, err := out.Write(data[id]); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(buffer, binary.BigEndian, crc.Sum32()); err != nil {
+		return err
+	}
+	return buffer.Flush()
+}
+
+// readSnapshot decodes a snapshot from r, validating it as a whole
+func readSnapshot(r io.Reader) (int64, map[int][]byte, error) {
+	buffer := bufio.NewReader(r)
+	crc := crc32.New(crcTable)
+	in := io.TeeReader(buffer, crc)
+	header := make([]byte, 4+4+8+8)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return 0, nil, invalid(err)
+	}
+	if string(header[0:4]) != SNAPSHOT_MAGIC {
+		return 0, nil, fmt.Errorf("%w: bad magic %q", ErrSnapshot, header[0:4])
+	}
+	if version := binary.BigEndian.Uint32(header[4:8]); version != SNAPSHOT_VERSION {
+		return 0, nil, fmt.Errorf("%w: unknown version %d", ErrSnapshot, version)
+	}
+	counter := int64(binary.BigEndian.Uint64(header[8:16]))
+	count := binary.BigEndian.Uint64(header[16:24])
+	data := make(map[int][]byte)
+	record := make([]byte, 8+4)
+	for i := uint64(0); i < count; i++ {
+		if _, err := io.ReadFull(in, record); err != nil {
+			return 0, nil, invalid(err)
+		}
+		id := int(binary.BigEndian.Uint64(record[0:8]))
+		// Copied as it goes, a corrupt length can't allocate
+		// more memory than the snapshot actually holds
+		var value bytes.Buffer
+		if _, err := io.CopyN(&value, in, int64(binary.BigEndian.Uint32(record[8:12]))); err != nil {
+			return 0, nil, invalid(err)
+		}
+		if id < 1 || int64(id) > counter {
+			return 0, nil, fmt.Errorf("%w: id %d out of range", ErrSnapshot, id)
+		}
+		data[id] = value.Bytes()
+	}
+	var sum uint32
+	if err := binary.Read(buffer, binary.BigEndian, &sum); err != nil {
+		return 0, nil, invalid(err)
+	}
+	if sum != crc.Sum32() {
+		return 0, nil, fmt.Errorf("%w: checksum mismatch", ErrSnapshot)
+	}
+	return counter, data, nil
+}
+
+// invalid reports a snapshot that ended too soon as ErrSnapshot
+func invalid(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: truncated", ErrSnapshot)
+	}
+	return err
+}
+
+// SaveSnapshot atomically writes the snapshot of s to path, it is written
+// to a temporary file in the same directory first and then renamed over
+// path, so a crash mid-write never leaves a partial snapshot behind. The
+// records it covers are dropped from the WAL of the store once renamed
+// and its directory synced, errors leave the WAL untouched.
+func SaveSnapshot(path string, s Snapshotter) error {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, name+".tmp*")
+	if err != nil {
+		return err
+	}
+	// Nothing to remove once renamed
+	defer os.Remove(tmp.Name())
+	seq := uint64(0)
+	c, ok := s.(checkpointer)
+	if ok {
+		seq, err = c.snapshot(tmp)
+	} else {
+		err = s.Snapshot(tmp)
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	// Data must be on disk before the rename makes it visible
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	// The rename must be durable before the WAL drops what it covers,
+	// the snapshot might not be in the directory of the WAL
+	if err := syncDir(path, (*os.File).Sync); err != nil {
+		return err
+	}
+	if ok {
+		return c.checkpoint(seq)
+	}
+	return nil
+}
+
+// LoadSnapshot restores s from the snapshot at path, missing
+// snapshots can be told apart with errors.Is(err, fs.ErrNotExist).
+func LoadSnapshot(path string, s Snapshotter) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return s.Restore(file)
+}
@@ -0,0 +1,174 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Data, pending writes and counter survive the round trip
+func TestSnapshot(t *testing.T) {
+	c := fake()
+	m := NewMemory(time.Second, WithClock(c))
+	for i := 1; i <= 10; i++ {
+		m.Set(context.Background(), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	c.Advance(time.Second)
+	m.Wait(context.Background(), 10)
+	m.Update(context.Background(), 5, []byte("updated"))
+	m.Set(context.Background(), []byte("pending"))
+	var buffer bytes.Buffer
+	equal(t, nil, m.Snapshot(&buffer))
+	c.Advance(time.Second)
+	m.Close()
+	// Final checkpoints are allowed after Close
+	equal(t, nil, m.Snapshot(&bytes.Buffer{}))
+
+	restored := NewMemory(0)
+	defer restored.Close()
+	equal(t, nil, restored.Restore(bytes.NewReader(buffer.Bytes())))
+	equal(t, 11, restored.Len())
+	value, _ := restored.Get(context.Background(), 1)
+	equal(t, "value-1", string(value))
+	value, _ = restored.Get(context.Background(), 5)
+	equal(t, "updated", string(value))
+	value, _ = restored.Get(context.Background(), 11)
+	equal(t, "pending", string(value))
+	// Restored only once
+	equal(t, ErrNotEmpty, restored.Restore(bytes.NewReader(buffer.Bytes())))
+	// Autoincrement keeps going from the counter
+	id, _ := restored.Set(context.Background(), []byte("next"))
+	equal(t, 12, id)
+	// Only stores that never issued an id can be restored
+	fresh := NewMemory(0)
+	fresh.Set(context.Background(), []byte("value"))
+	equal(t, ErrNotEmpty, fresh.Restore(bytes.NewReader(buffer.Bytes())))
+	fresh.Close()
+}
+
+// The writes replayed from the WAL newer than the snapshot
+// are applied on top of it once restored
+func TestSnapshotWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hashes.wal")
+	policy := SyncPolicy{Mode: SYNC_ALWAYS}
+	wal, _ := OpenWAL(path, policy)
+	c := fake()
+	crashed := NewMemory(time.Second, WithClock(c), WithWAL(wal))
+	crashed.Set(context.Background(), []byte("value-1"))
+	crashed.Set(context.Background(), []byte("value-2"))
+	c.Advance(time.Second)
+	crashed.Wait(context.Background(), 2)
+	var buffer bytes.Buffer
+	crashed.Snapshot(&buffer)
+	crashed.Update(context.Background(), 1, []byte("updated"))
+	crashed.Set(context.Background(), []byte("value-3"))
+
+	wal, _ = OpenWAL(path, policy)
+	m := NewMemory(0, WithWAL(wal))
+	defer m.Close()
+	equal(t, nil, m.Restore(bytes.NewReader(buffer.Bytes())))
+	equal(t, 3, m.Len())
+	value, _ := m.Get(context.Background(), 1)
+	equal(t, "updated", string(value))
+	value, _ = m.Get(context.Background(), 3)
+	equal(t, "value-3", string(value))
+	id, _ := m.Set(context.Background(), []byte("value-4"))
+	equal(t, 4, id)
+
+	c.Advance(time.Second)
+	crashed.Close()
+}
+
+// Invalid snapshots are rejected as a whole
+func TestSnapshotInvalid(t *testing.T) {
+	m := NewMemory(0)
+	m.Set(context.Background(), []byte("value"))
+	m.Close()
+	var buffer bytes.Buffer
+	m.Snapshot(&buffer)
+	snapshot := buffer.Bytes()
+
+	corrupt := append([]byte(nil), snapshot...)
+	corrupt[len(corrupt)-5] ^= 0xFF
+	version := append([]byte(nil), snapshot...)
+	version[7] = 2
+	cases := map[string][]byte{
+		"empty":     {},
+		"truncated": snapshot[:len(snapshot)-1],
+		"magic":     append([]byte("JUNK"), snapshot[4:]...),
+		"version":   version,
+		"checksum":  corrupt,
+	}
+	for name, data := range cases {
+		restored := NewMemory(0)
+		err := restored.Restore(bytes.NewReader(data))
+		if !errors.Is(err, ErrSnapshot) {
+			t.Errorf("%s: expected ErrSnapshot - got: %v", name, err)
+		}
+		equal(t, 0, restored.Len())
+		restored.Close()
+	}
+}
+
+func TestSaveSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hashes.snapshot")
+	m := NewMemory(0)
+	equal(t, true, errors.Is(LoadSnapshot(path, m), fs.ErrNotExist))
+	m.Set(context.Background(), []byte("value"))
+	m.Close()
+	equal(t, nil, SaveSnapshot(path, m))
+	// Overwrites the previous one, leaving no temporary files
+	equal(t, nil, SaveSnapshot(path, m))
+	files, _ := os.ReadDir(filepath.Dir(path))
+	equal(t, 1, len(files))
+
+	restored := NewMemory(0)
+	defer restored.Close()
+	equal(t, nil, LoadSnapshot(path, restored))
+	value, _ := restored.Get(context.Background(), 1)
+	equal(t, "value", string(value))
+	equal(t, true, SaveSnapshot(filepath.Join(path, "missing"), m) != nil)
+}
+
+// Saved snapshots drop the records they cover from the WAL, the
+// ones logged after it are replayed on top of it on restore
+func TestSaveSnapshotWAL(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hashes.snapshot")
+	wal, _ := OpenWAL(filepath.Join(dir, "hashes.wal"), SyncPolicy{Mode: SYNC_ALWAYS})
+	c := fake()
+	crashed := NewMemory(time.Second, WithClock(c), WithWAL(wal))
+	crashed.Set(context.Background(), []byte("value-1"))
+	c.Advance(time.Second)
+	crashed.Wait(context.Background(), 1)
+	crashed.Set(context.Background(), []byte("value-2"))
+	equal(t, nil, SaveSnapshot(path, crashed))
+	info, _ := os.Stat(filepath.Join(dir, "hashes.wal"))
+	equal(t, int64(0), info.Size())
+	crashed.Update(context.Background(), 1, []byte("updated"))
+	crashed.Set(context.Background(), []byte("value-3"))
+
+	wal, _ = OpenWAL(filepath.Join(dir, "hashes.wal"), SyncPolicy{Mode: SYNC_ALWAYS})
+	equal(t, 2, len(wal.entries))
+	m := NewMemory(0, WithWAL(wal))
+	equal(t, nil, LoadSnapshot(path, m))
+	equal(t, 3, m.Len())
+	value, _ := m.Get(context.Background(), 1)
+	equal(t, "updated", string(value))
+	value, _ = m.Get(context.Background(), 2)
+	equal(t, "value-2", string(value))
+	// A final snapshot after Close empties the WAL
+	m.Close()
+	equal(t, nil, SaveSnapshot(path, m))
+	info, _ = os.Stat(filepath.Join(dir, "hashes.wal"))
+	equal(t, int64(0), info.Size())
+
+	c.Advance(time.Second)
+	crashed.Close()
+}
@@ -1,11 +1,124 @@
 package store
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/phrozen/password-hash-exercise/internal/clock"
+)
+
+// Write lifecycle events reported to observers
+const (
+	EVENT_ACCEPTED  = "accepted"
+	EVENT_PERSISTED = "persisted"
+)
+
+var (
+	// ErrNotFound is returned for ids that were never issued
+	ErrNotFound = errors.New("Not Found")
+	// ErrPending is returned for issued ids whose delayed write
+	// has not been done yet, the value will be there eventually.
+	ErrPending = errors.New("Pending")
+	// ErrBackpressure is returned when the store can't take
+	// more pending writes, the request can be retried later.
+	ErrBackpressure = errors.New("Backpressure")
+	// ErrFull is the same as ErrBackpressure, named after
+	// the state of the store instead of the mechanism.
+	ErrFull = ErrBackpressure
+	// ErrClosed is returned for writes after Close
+	ErrClosed = errors.New("Closed")
+)
+
+// PendingError is returned for an id issued but not written yet,
+// it reports the remaining time for the write and matches ErrPending
+// with errors.Is so callers not interested in the delay can ignore it.
+type PendingError struct {
+	ID        int
+	Remaining time.Duration
+}
+
+func (e *PendingError) Error() string {
+	return fmt.Sprintf("%s: id %d will be written in %v", ErrPending, e.ID, e.Remaining)
+}
+
+func (e *PendingError) Is(target error) bool {
+	return target == ErrPending
+}
+
+// BackpressureError is returned by Set when the maximum number of pending
+// writes is reached, it reports when the next pending write is due (room
+// for a new one) and matches ErrBackpressure with errors.Is.
+type BackpressureError struct {
+	Max        int
+	RetryAfter time.Duration
+}
+
+func (e *BackpressureError) Error() string {
+	return fmt.Sprintf("%s: %d pending writes, retry in %v", ErrBackpressure, e.Max, e.RetryAfter)
+}
+
+func (e *BackpressureError) Is(target error) bool {
+	return target == ErrBackpressure
+}
+
+// Option configures the delayed writes of a Store implementation
+type Option func(*scheduler)
+
+// WithBackpressure limits the number of pending writes to max (0 means
+// unlimited), once reached Set blocks up to wait for a pending write to
+// be done or fails with a *BackpressureError (fails fast if wait is 0),
+// a context done while waiting fails with its own error instead.
+func WithBackpressure(max int, wait time.Duration) Option {
+	return func(s *scheduler) {
+		s.max = max
+		s.timeout = wait
+	}
+}
+
+// WithClock replaces the real clock used for delayed writes, tests
+// can use a clock.Fake to move time forward without sleeping.
+func WithClock(c clock.Clock) Option {
+	return func(s *scheduler) {
+		s.clock = c
+	}
+}
+
+// WithWAL logs every accepted write on w before Set returns, so writes
+// still pending survive a crash, the ones missing from the store are
+// replayed when it is created. The store closes w on Close.
+func WithWAL(w *WAL) Option {
+	return func(s *scheduler) {
+		s.wal = w
+	}
+}
+
 // Store defines an interface for a store of any byte slice that
 // tracks the elements with an integer id in incremental fashion.
+// Operations take a context first, so deadlines and cancellation
+// (e.g. a client disconnecting) can stop work before it is done,
+// a done context fails with its error (context.Canceled, etc...).
+// Other failures are reported with the sentinel errors above (or
+// errors matching them with errors.Is) so callers can tell them apart.
+// Update replaces the value of an id that was already written, right
+// away and without issuing a new id (e.g. upgrading a password hash).
+// Wait blocks until a pending id is written or ctx is done, so callers
+// can be notified of delayed writes without polling, it returns right
+// away for ids that are not pending (written or never issued).
+// Observe registers a function to be called on every write lifecycle event,
+// when an id is accepted (Set) and when its delayed write is persisted.
+// Len and Pending return the number of values written and waiting
+// to be written respectively, for monitoring purposes.
 // Close is added as it is a common practice for other non-trivial
 // implementations to perform tear down processes like graceful shutdown.
 type Store interface {
-	Get(int) ([]byte, error)
-	Set([]byte) (int, error)
+	Get(context.Context, int) ([]byte, error)
+	Set(context.Context, []byte) (int, error)
+	Update(context.Context, int, []byte) error
+	Wait(context.Context, int) error
+	Observe(func(event string, id int))
+	Len() int
+	Pending() int
 	Close() error
 }
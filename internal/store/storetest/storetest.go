@@ -0,0 +1,384 @@
+/*
+Storetest package provides a conformance test suite for store.Store
+implementations, every backend must behave the same way from the
+application's point of view (ids, delayed writes, lifecycle), so new
+backends only need to plug a factory into RunConformance:
+
+	func TestConformance(t *testing.T) {
+		storetest.RunConformance(t, func(t *testing.T, delay time.Duration, c clock.Clock) store.Store {
+			return store.NewMemory(delay, store.WithClock(c))
+		})
+	}
+
+Backends keeping their writes across restarts (on their own or with a
+WAL) plug a Durable factory into RunRecovery as well.
+
+Stores are given a clock.Fake, so delays are exact and the suite never
+sleeps. Run with -race, as most of the suite is about concurrency.
+*/
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/phrozen/password-hash-exercise/internal/clock"
+	"github.com/phrozen/password-hash-exercise/internal/store"
+)
+
+// Delay used for stores where writes must be seen pending, writes
+// are only done once the fake clock is advanced past it.
+const DELAY = 100 * time.Millisecond
+
+// Factory returns a new empty Store with the given write delay on the
+// given clock (store.WithClock), it is called once per test so stores
+// never share state, the suite closes the stores it creates.
+type Factory func(t *testing.T, delay time.Duration, c clock.Clock) store.Store
+
+// RunConformance runs the whole suite against the stores created by
+// factory, each behavior on its own subtest.
+func RunConformance(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		run  func(*testing.T, Factory)
+	}{
+		{"IDs", testIDs},
+		{"Concurrent", testConcurrent},
+		{"Pending", testPending},
+		{"Update", testUpdate},
+		{"Observe", testObserve},
+		{"Cancel", testCancel},
+		{"CloseFlush", testCloseFlush},
+		{"AfterClose", testAfterClose},
+		{"LargeValues", testLargeValues},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, factory)
+		})
+	}
+}
+
+// Durable returns a Store keeping its data under dir (in-memory stores
+// with a WAL there), a store opened again on the same dir must recover
+// every write and update done by the previous one.
+type Durable func(t *testing.T, dir string, delay time.Duration, c clock.Clock) store.Store
+
+// Breaker is implemented by stores (usually in their tests) able to make
+// the writes they apply fail, as a full disk would, until restore is
+// called. RunRecovery skips the fault cases for stores without it.
+type Breaker interface {
+	Break() (restore func())
+}
+
+// RunRecovery runs the recovery cases against the stores created by
+// durable, each on its own subtest, on top of RunConformance.
+func RunRecovery(t *testing.T, durable Durable) {
+	tests := []struct {
+		name string
+		run  func(*testing.T, Durable)
+	}{
+		{"Reopen", testReopen},
+		{"ReplayUpdate", testReplayUpdate},
+		{"ReplayFailed", testReplayFailed},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, durable)
+		})
+	}
+}
+
+// equal is the only assertion needed by the suite
+func equal(t *testing.T, want, have any) {
+	t.Helper()
+	if want != have {
+		t.Errorf("expected: %v - got: %v", want, have)
+	}
+}
+
+// open creates a store on a fake clock closed at the end of the test,
+// the clock is advanced past every pending write before closing it
+func open(t *testing.T, factory Factory, delay time.Duration) (store.Store, *clock.Fake) {
+	c := fake()
+	s := factory(t, delay, c)
+	t.Cleanup(func() {
+		c.Advance(delay)
+		s.Close()
+	})
+	return s, c
+}
+
+// fake returns a clock that only moves with Advance
+func fake() *clock.Fake {
+	return clock.NewFake(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+}
+
+// Ids start at 1 and are handed out in autoincrement fashion
+func testIDs(t *testing.T, factory Factory) {
+	s, _ := open(t, factory, 0)
+	for i := 1; i <= 100; i++ {
+		id, err := s.Set(context.Background(), []byte(fmt.Sprint(i)))
+		equal(t, nil, err)
+		equal(t, i, id)
+	}
+}
+
+// Concurrent writes get unique ids and readers see their values
+func testConcurrent(t *testing.T, factory Factory) {
+	s, _ := open(t, factory, 0)
+	const WRITERS = 50
+	ids := make(chan int, WRITERS)
+	var wg sync.WaitGroup
+	for i := 0; i < WRITERS; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			value := []byte(fmt.Sprintf("value-%d", i))
+			id, err := s.Set(context.Background(), value)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ids <- id
+			if err := s.Wait(context.Background(), id); err != nil {
+				t.Error(err)
+			}
+			output, err := s.Get(context.Background(), id)
+			equal(t, nil, err)
+			equal(t, string(value), string(output))
+		}(i)
+	}
+	wg.Wait()
+	close(ids)
+	seen := make(map[int]bool)
+	for id := range ids {
+		if seen[id] || id < 1 || id > WRITERS {
+			t.Errorf("unexpected id: %d", id)
+		}
+		seen[id] = true
+	}
+	equal(t, WRITERS, len(seen))
+	equal(t, WRITERS, s.Len())
+}
+
+// Issued ids are pending until the delay is over, unknown ids are not found
+func testPending(t *testing.T, factory Factory) {
+	s, c := open(t, factory, DELAY)
+	id, err := s.Set(context.Background(), []byte("test"))
+	equal(t, nil, err)
+	c.Advance(DELAY / 4)
+	_, err = s.Get(context.Background(), id)
+	equal(t, true, errors.Is(err, store.ErrPending))
+	var pending *store.PendingError
+	if errors.As(err, &pending) {
+		equal(t, id, pending.ID)
+		equal(t, DELAY*3/4, pending.Remaining)
+	} else {
+		t.Errorf("expected a *store.PendingError - got: %v", err)
+	}
+	_, err = s.Get(context.Background(), id+1)
+	equal(t, store.ErrNotFound, err)
+	equal(t, 1, s.Pending())
+	equal(t, 0, s.Len())
+	// Unknown ids don't block
+	equal(t, nil, s.Wait(context.Background(), id+1))
+	c.Advance(DELAY * 3 / 4)
+	equal(t, nil, s.Wait(context.Background(), id))
+	output, err := s.Get(context.Background(), id)
+	equal(t, nil, err)
+	equal(t, "test", string(output))
+	equal(t, 0, s.Pending())
+	equal(t, 1, s.Len())
+}
+
+// Only written values can be updated, without issuing a new id
+func testUpdate(t *testing.T, factory Factory) {
+	s, c := open(t, factory, DELAY)
+	id, _ := s.Set(context.Background(), []byte("old"))
+	equal(t, true, errors.Is(s.Update(context.Background(), id, []byte("new")), store.ErrPending))
+	equal(t, store.ErrNotFound, s.Update(context.Background(), id+1, []byte("new")))
+	c.Advance(DELAY)
+	s.Wait(context.Background(), id)
+	equal(t, nil, s.Update(context.Background(), id, []byte("new")))
+	output, err := s.Get(context.Background(), id)
+	equal(t, nil, err)
+	equal(t, "new", string(output))
+	equal(t, 1, s.Len())
+}
+
+// Observers get both lifecycle events of every write, in order
+func testObserve(t *testing.T, factory Factory) {
+	s, _ := open(t, factory, 0)
+	const WRITES = 100
+	events := make(chan string, 2*WRITES)
+	s.Observe(func(event string, id int) {
+		events <- fmt.Sprintf("%s %d", event, id)
+	})
+	// With no delay the write is applied right away, racing with Set
+	for i := 0; i < WRITES; i++ {
+		id, _ := s.Set(context.Background(), []byte("test"))
+		equal(t, fmt.Sprintf("%s %d", store.EVENT_ACCEPTED, id), <-events)
+		equal(t, fmt.Sprintf("%s %d", store.EVENT_PERSISTED, id), <-events)
+	}
+}
+
+// Done contexts fail with their error, without issuing ids
+func testCancel(t *testing.T, factory Factory) {
+	s, _ := open(t, factory, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := s.Set(ctx, []byte("test"))
+	equal(t, context.Canceled, err)
+	id, _ := s.Set(context.Background(), []byte("test"))
+	equal(t, 1, id)
+	s.Wait(context.Background(), id)
+	_, err = s.Get(ctx, id)
+	equal(t, context.Canceled, err)
+	equal(t, context.Canceled, s.Update(ctx, id, []byte("new")))
+}
+
+// Close blocks until every pending write is done
+func testCloseFlush(t *testing.T, factory Factory) {
+	c := fake()
+	s := factory(t, DELAY, c)
+	persisted := make(chan int, 10)
+	s.Observe(func(event string, id int) {
+		if event == store.EVENT_PERSISTED {
+			persisted <- id
+		}
+	})
+	for i := 0; i < 10; i++ {
+		s.Set(context.Background(), []byte("test"))
+	}
+	closed := make(chan error)
+	go func() {
+		closed <- s.Close()
+	}()
+	// Writes are only due once the clock moves
+	c.BlockUntil(1)
+	select {
+	case <-closed:
+		t.Fatal("Close returned before the pending writes were done")
+	default:
+	}
+	equal(t, 0, len(persisted))
+	c.Advance(DELAY)
+	equal(t, nil, <-closed)
+	equal(t, 10, len(persisted))
+	equal(t, 10, s.Len())
+	equal(t, 0, s.Pending())
+}
+
+// Everything is rejected with ErrClosed, closing again is safe
+func testAfterClose(t *testing.T, factory Factory) {
+	s := factory(t, 0, fake())
+	id, _ := s.Set(context.Background(), []byte("test"))
+	equal(t, nil, s.Close())
+	_, err := s.Set(context.Background(), []byte("test"))
+	equal(t, store.ErrClosed, err)
+	_, err = s.Get(context.Background(), id)
+	equal(t, store.ErrClosed, err)
+	equal(t, store.ErrClosed, s.Update(context.Background(), id, []byte("new")))
+	equal(t, nil, s.Wait(context.Background(), id))
+	equal(t, nil, s.Close())
+}
+
+// Values are kept byte by byte, from empty to a few megabytes
+func testLargeValues(t *testing.T, factory Factory) {
+	s, _ := open(t, factory, 0)
+	for _, size := range []int{0, 1, 4 << 10, 4 << 20} {
+		value := make([]byte, size)
+		rand.Read(value)
+		id, err := s.Set(context.Background(), value)
+		equal(t, nil, err)
+		s.Wait(context.Background(), id)
+		output, err := s.Get(context.Background(), id)
+		equal(t, nil, err)
+		equal(t, true, bytes.Equal(value, output))
+	}
+}
+
+// reopen closes s and opens a new store on the same dir
+func reopen(t *testing.T, durable Durable, dir string, s store.Store) store.Store {
+	equal(t, nil, s.Close())
+	s = durable(t, dir, 0, fake())
+	t.Cleanup(func() {
+		s.Close()
+	})
+	return s
+}
+
+// Writes done (and pending ones flushed by Close) are kept, and
+// ids go on from the last one
+func testReopen(t *testing.T, durable Durable) {
+	dir := t.TempDir()
+	s := durable(t, dir, 0, fake())
+	for i := 1; i <= 10; i++ {
+		s.Set(context.Background(), []byte(fmt.Sprint(i)))
+	}
+	s = reopen(t, durable, dir, s)
+	equal(t, 10, s.Len())
+	output, err := s.Get(context.Background(), 10)
+	equal(t, nil, err)
+	equal(t, "10", string(output))
+	id, _ := s.Set(context.Background(), []byte("11"))
+	equal(t, 11, id)
+}
+
+// Updated ids keep their last value and are only counted once
+func testReplayUpdate(t *testing.T, durable Durable) {
+	dir := t.TempDir()
+	s := durable(t, dir, 0, fake())
+	id, _ := s.Set(context.Background(), []byte("old"))
+	s.Wait(context.Background(), id)
+	equal(t, nil, s.Update(context.Background(), id, []byte("new")))
+	s = reopen(t, durable, dir, s)
+	equal(t, 1, s.Len())
+	output, err := s.Get(context.Background(), id)
+	equal(t, nil, err)
+	equal(t, "new", string(output))
+}
+
+// Writes the store failed to apply are replayed from the WAL, even
+// when a write after them was applied (their id is not the last)
+func testReplayFailed(t *testing.T, durable Durable) {
+	dir := t.TempDir()
+	c := fake()
+	s := durable(t, dir, DELAY, c)
+	b, ok := s.(Breaker)
+	if !ok {
+		s.Close()
+		t.Skip("store can't be made to fail its writes")
+	}
+	lost, _ := s.Set(context.Background(), []byte("lost"))
+	restore := b.Break()
+	c.Advance(DELAY)
+	s.Wait(context.Background(), lost)
+	restore()
+	kept, _ := s.Set(context.Background(), []byte("kept"))
+	c.Advance(DELAY)
+	s.Wait(context.Background(), kept)
+	// The failure is reported once closed, the WAL keeps the write
+	equal(t, true, s.Close() != nil)
+	s = durable(t, dir, 0, fake())
+	t.Cleanup(func() {
+		s.Close()
+	})
+	equal(t, 2, s.Len())
+	for id, value := range map[int]string{lost: "lost", kept: "kept"} {
+		output, err := s.Get(context.Background(), id)
+		equal(t, nil, err)
+		equal(t, value, string(output))
+	}
+	id, _ := s.Set(context.Background(), []byte("next"))
+	equal(t, kept+1, id)
+}
@@ -0,0 +1,489 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sync policies of the WAL, from the most durable to the fastest
+const (
+	// Every Set waits for its record to be synced to disk
+	SYNC_ALWAYS = "always"
+	// Records are written right away and synced periodically
+	SYNC_INTERVAL = "interval"
+	// Records are written right away and the OS syncs them
+	SYNC_NEVER = "never"
+)
+
+// WAL_CHECKPOINT_SIZE is the size past which stores whose writes are durable
+// on their own drop the records of the writes already applied from the WAL
+const WAL_CHECKPOINT_SIZE = 4 << 20
+
+// Every WAL record is a File record (see headerSize) preceded by its
+// kind (byte), either a new value (Set) or the update of a written one,
+// the checksum covers the kind as well.
+const (
+	walSet        = 1
+	walUpdate     = 2
+	walHeaderSize = 1 + headerSize
+)
+
+// SyncPolicy tells the WAL when records are synced to disk (fsync)
+type SyncPolicy struct {
+	Mode     string
+	Interval time.Duration
+}
+
+// ParseSyncPolicy parses "always", "never" or "interval=<duration>"
+func ParseSyncPolicy(value string) (SyncPolicy, error) {
+	mode, interval, found := strings.Cut(value, "=")
+	switch {
+	case mode == SYNC_ALWAYS && !found, mode == SYNC_NEVER && !found:
+		return SyncPolicy{Mode: mode}, nil
+	case mode == SYNC_INTERVAL && found:
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			return SyncPolicy{}, fmt.Errorf("invalid sync interval: %s", interval)
+		}
+		return SyncPolicy{Mode: mode, Interval: d}, nil
+	}
+	return SyncPolicy{}, fmt.Errorf("unknown sync policy: %s", value)
+}
+
+// WAL is a write-ahead log of the writes accepted by a Store, records
+// are appended at Set time (before the delay elapses) so writes still
+// pending survive a crash, and the ones the Store is missing on startup
+// are replayed (WithWAL). Updates are logged too, before they are done.
+//
+// Appends only buffer the record (in id order, as they are done under
+// the scheduler lock), and the caller then commits it. Concurrent commits
+// are batched (group commit): the first caller writes and syncs every
+// record buffered so far, while the rest wait for it and return without
+// any I/O if their record was part of the batch. Errors are sticky, once
+// a write or sync fails every commit after it fails too.
+//
+// Records are numbered in order (sequence), the ones read on open first,
+// so the records of writes durable elsewhere can be dropped from the
+// start of the WAL with a checkpoint.
+type WAL struct {
+	sync.Mutex
+	cond      *sync.Cond
+	path      string
+	file      *os.File
+	fsync     func(*os.File) error
+	policy    SyncPolicy
+	buffer    []byte
+	size      int64
+	limit     int64
+	base      uint64
+	appended  uint64
+	committed uint64
+	flushing  bool
+	syncs     int
+	err       error
+	closed    bool
+	entries   []walEntry
+	quit      chan struct{}
+	done      chan struct{}
+}
+
+// walEntry is a record read from the WAL on open
+type walEntry struct {
+	kind  byte
+	id    int
+	value []byte
+}
+
+// OpenWAL opens (or creates) the WAL at path, reading the records logged
+// on previous runs to be replayed. A torn final record is truncated.
+func OpenWAL(path string, policy SyncPolicy) (*WAL, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w := &WAL{
+		path:   path,
+		file:   file,
+		fsync:  (*os.File).Sync,
+		policy: policy,
+		limit:  WAL_CHECKPOINT_SIZE,
+	}
+	w.cond = sync.NewCond(&w.Mutex)
+	if err := w.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	w.appended = uint64(len(w.entries))
+	w.committed = w.appended
+	if policy.Mode == SYNC_INTERVAL {
+		w.quit = make(chan struct{})
+		w.done = make(chan struct{})
+		go w.syncer()
+	}
+	return w, nil
+}
+
+// load reads every valid record and truncates the WAL after the last one
+func (w *WAL) load() error {
+	info, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(w.file)
+	header := make([]byte, walHeaderSize)
+	size := int64(0)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+		length := binary.BigEndian.Uint32(header[9:13])
+		// A torn header might claim more data than the WAL holds
+		if size+walHeaderSize+int64(length) > info.Size() {
+			break
+		}
+		record := make([]byte, walHeaderSize+int(length))
+		copy(record, header)
+		if _, err := io.ReadFull(reader, record[walHeaderSize:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+		if binary.BigEndian.Uint32(header[13:17]) != walChecksum(record) {
+			break
+		}
+		id := int(binary.BigEndian.Uint64(header[1:9]))
+		w.entries = append(w.entries, walEntry{header[0], id, record[walHeaderSize:]})
+		size += int64(len(record))
+	}
+	w.size = size
+	return w.file.Truncate(size)
+}
+
+// recovered hands over the records read on open, only once
+func (w *WAL) recovered() []walEntry {
+	w.Lock()
+	defer w.Unlock()
+	entries := w.entries
+	w.entries = nil
+	return entries
+}
+
+// append buffers a record of the given kind and returns its sequence
+// number, to be committed outside of the scheduler lock.
+func (w *WAL) append(kind byte, id int, value []byte) uint64 {
+	w.Lock()
+	defer w.Unlock()
+	w.buffer = append(w.buffer, encodeWAL(kind, id, value)...)
+	w.appended++
+	return w.appended
+}
+
+// commit blocks until the record seq is written to the file, and synced
+// if the policy is SYNC_ALWAYS, batching it with every other record
+// buffered by then.
+func (w *WAL) commit(seq uint64) error {
+	w.Lock()
+	defer w.Unlock()
+	for w.committed < seq {
+		if w.err != nil {
+			return w.err
+		}
+		if w.flushing {
+			w.cond.Wait()
+			continue
+		}
+		// Leader of the batch, I/O is done without the lock so
+		// records keep being buffered for the next batch
+		batch, last := w.buffer, w.appended
+		w.buffer = nil
+		w.flushing = true
+		w.Unlock()
+		err := w.flush(batch, w.policy.Mode == SYNC_ALWAYS)
+		w.Lock()
+		w.flushing = false
+		if err != nil {
+			w.err = err
+		} else {
+			w.size += int64(len(batch))
+			w.committed = last
+		}
+		w.cond.Broadcast()
+	}
+	return nil
+}
+
+// flush writes a batch of records, syncing the file if needed
+func (w *WAL) flush(batch []byte, sync bool) error {
+	if _, err := w.file.Write(batch); err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+	if !sync {
+		return nil
+	}
+	w.syncs++
+	if err := w.fsync(w.file); err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+	return nil
+}
+
+// syncer syncs the file every interval until Close (SYNC_INTERVAL), as
+// if it was flushing a batch, so the file is not replaced meanwhile
+func (w *WAL) syncer() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.policy.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Lock()
+			w.idle()
+			w.flushing = true
+			w.Unlock()
+			err := w.fsync(w.file)
+			w.Lock()
+			w.flushing = false
+			if err != nil && w.err == nil {
+				w.err = fmt.Errorf("wal: %w", err)
+			}
+			w.cond.Broadcast()
+			w.Unlock()
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+// last returns the sequence of the last record appended
+func (w *WAL) last() uint64 {
+	w.Lock()
+	defer w.Unlock()
+	return w.appended
+}
+
+// full tells if the WAL grew past its checkpoint limit
+func (w *WAL) full() bool {
+	w.Lock()
+	defer w.Unlock()
+	return w.size >= w.limit
+}
+
+// checkpoint drops the records up to seq from the start of the WAL, must
+// only be called once every write they hold is durable elsewhere. The
+// records left are copied to a new file renamed over the WAL, so a crash
+// leaves either one in place, and the directory is synced so the rename
+// is durable. Records not written yet stay buffered. Errors are sticky
+// like the ones of commit, a WAL that failed to be replaced might not
+// be the one found on the next run. Once closed, only a final checkpoint
+// covering every record can be done, emptying the WAL.
+func (w *WAL) checkpoint(seq uint64) error {
+	w.Lock()
+	defer w.Unlock()
+	w.idle()
+	if w.closed {
+		if seq < w.appended {
+			return nil
+		}
+		if err := w.empty(); err != nil {
+			return w.fail(err)
+		}
+		return nil
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if seq > w.committed {
+		seq = w.committed
+	}
+	if seq <= w.base {
+		return nil
+	}
+	offset, err := w.offset(seq - w.base)
+	if err != nil {
+		return w.fail(err)
+	}
+	if err := w.rewrite(offset); err != nil {
+		return w.fail(err)
+	}
+	w.size -= offset
+	w.base = seq
+	if err := w.syncDir(); err != nil {
+		return w.fail(err)
+	}
+	return nil
+}
+
+// fail makes err sticky, so every commit after it fails too, keeping
+// the first error found (ErrClosed once closed), and returns it wrapped.
+// Must be called with the lock held.
+func (w *WAL) fail(err error) error {
+	err = fmt.Errorf("wal: %w", err)
+	if w.err == nil {
+		w.err = err
+	}
+	return err
+}
+
+// syncDir syncs the directory of the WAL, so the file renamed over it
+// is found after a crash
+func (w *WAL) syncDir() error {
+	return syncDir(w.path, w.fsync)
+}
+
+// empty truncates the file of a closed WAL through a new handle, syncing
+// it and its directory, so the truncation is durable like Truncate
+func (w *WAL) empty() error {
+	file, err := os.OpenFile(w.path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	if err := w.fsync(file); err != nil {
+		return err
+	}
+	return w.syncDir()
+}
+
+// syncDir syncs the directory holding path with fsync, so a file
+// renamed over path is found there after a crash
+func syncDir(path string, fsync func(*os.File) error) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return fsync(dir)
+}
+
+// offset returns where the record after the first n ones starts
+func (w *WAL) offset(n uint64) (int64, error) {
+	header := make([]byte, walHeaderSize)
+	offset := int64(0)
+	for i := uint64(0); i < n; i++ {
+		if _, err := w.file.ReadAt(header, offset); err != nil {
+			return 0, err
+		}
+		offset += walHeaderSize + int64(binary.BigEndian.Uint32(header[9:13]))
+	}
+	return offset, nil
+}
+
+// rewrite replaces the file with a copy of its records from offset on,
+// the WAL is left untouched on errors
+func (w *WAL) rewrite(offset int64) error {
+	tail := make([]byte, w.size-offset)
+	if _, err := w.file.ReadAt(tail, offset); err != nil {
+		return err
+	}
+	tmp := w.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(tail); err != nil {
+		file.Close()
+		return err
+	}
+	if err := w.fsync(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := os.Rename(tmp, w.path); err != nil {
+		file.Close()
+		return err
+	}
+	w.file.Close()
+	w.file = file
+	return nil
+}
+
+// idle blocks until no batch is being flushed, must be called with the
+// lock held. Used to get exclusive access to the file.
+func (w *WAL) idle() {
+	for w.flushing {
+		w.cond.Wait()
+	}
+}
+
+// Truncate empties the WAL, must only be called once every write it
+// holds is durable elsewhere (e.g. applied and synced by the Store).
+func (w *WAL) Truncate() error {
+	w.Lock()
+	defer w.Unlock()
+	w.idle()
+	w.buffer = nil
+	w.committed = w.appended
+	w.base = w.appended
+	w.size = 0
+	if err := w.file.Truncate(0); err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+	return w.file.Sync()
+}
+
+// encodeWAL returns the WAL record of kind for id and value
+func encodeWAL(kind byte, id int, value []byte) []byte {
+	record := make([]byte, walHeaderSize+len(value))
+	record[0] = kind
+	binary.BigEndian.PutUint64(record[1:9], uint64(id))
+	binary.BigEndian.PutUint32(record[9:13], uint32(len(value)))
+	copy(record[walHeaderSize:], value)
+	binary.BigEndian.PutUint32(record[13:17], walChecksum(record))
+	return record
+}
+
+// walChecksum of a WAL record ignoring its own checksum field
+func walChecksum(record []byte) uint32 {
+	crc := crc32.Update(0, crcTable, record[0:13])
+	return crc32.Update(crc, crcTable, record[walHeaderSize:])
+}
+
+// Close writes and syncs the records still buffered and closes the file,
+// commits of records written by Close succeed, later ones fail.
+// It is safe to call it again, nil is returned then.
+func (w *WAL) Close() error {
+	w.Lock()
+	if w.closed {
+		w.Unlock()
+		return nil
+	}
+	w.closed = true
+	w.Unlock()
+	// The syncer takes the lock on errors, stop it without holding it
+	if w.quit != nil {
+		close(w.quit)
+		<-w.done
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.idle()
+	err := w.err
+	if err == nil {
+		if err = w.flush(w.buffer, true); err == nil {
+			w.committed = w.appended
+		}
+	}
+	w.buffer = nil
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	// Wake up late commits so they fail
+	w.err = ErrClosed
+	w.cond.Broadcast()
+	return err
+}
@@ -0,0 +1,312 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseSyncPolicy(t *testing.T) {
+	valid := map[string]SyncPolicy{
+		"always":        {Mode: SYNC_ALWAYS},
+		"never":         {Mode: SYNC_NEVER},
+		"interval=10ms": {Mode: SYNC_INTERVAL, Interval: 10 * time.Millisecond},
+	}
+	for value, want := range valid {
+		policy, err := ParseSyncPolicy(value)
+		equal(t, nil, err)
+		equal(t, want, policy)
+	}
+	for _, value := range []string{"", "sometimes", "always=1s", "interval", "interval=abc", "interval=-1s"} {
+		_, err := ParseSyncPolicy(value)
+		equal(t, true, err != nil)
+	}
+}
+
+// Pending writes survive a crash (the store is never closed) and are
+// replayed by the next store, for every sync policy
+func TestWALReplay(t *testing.T) {
+	for _, value := range []string{"always", "never", "interval=1ms"} {
+		policy, _ := ParseSyncPolicy(value)
+		path := filepath.Join(t.TempDir(), "hashes.wal")
+		wal, err := OpenWAL(path, policy)
+		equal(t, nil, err)
+		c := fake()
+		crashed := NewMemory(time.Hour, WithClock(c), WithWAL(wal))
+		for i := 1; i <= 10; i++ {
+			crashed.Set(context.Background(), []byte(fmt.Sprintf("value-%d", i)))
+		}
+
+		recovered, err := OpenWAL(path, policy)
+		equal(t, nil, err)
+		m := NewMemory(0, WithWAL(recovered))
+		equal(t, 10, m.Len())
+		value, _ := m.Get(context.Background(), 10)
+		equal(t, "value-10", string(value))
+		id, _ := m.Set(context.Background(), []byte("value-11"))
+		equal(t, 11, id)
+		equal(t, nil, m.Close())
+		// Memory keeps every write on the WAL
+		recovered, _ = OpenWAL(path, policy)
+		equal(t, 11, len(recovered.recovered()))
+		recovered.Close()
+
+		c.Advance(time.Hour)
+		crashed.Close()
+	}
+}
+
+// Only the writes missing from the log are replayed, and the WAL is
+// emptied once they are on the log
+func TestWALFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hashes.wal")
+	policy := SyncPolicy{Mode: SYNC_ALWAYS}
+	wal, _ := OpenWAL(path, policy)
+	c := fake()
+	crashed, err := NewFile(dir, time.Second, WithClock(c), WithWAL(wal))
+	equal(t, nil, err)
+	crashed.Set(context.Background(), []byte("written"))
+	c.Advance(time.Second)
+	crashed.Wait(context.Background(), 1)
+	crashed.Set(context.Background(), []byte("pending"))
+
+	wal, _ = OpenWAL(path, policy)
+	store, err := NewFile(dir, 0, WithWAL(wal))
+	equal(t, nil, err)
+	equal(t, 2, store.Len())
+	value, _ := store.Get(context.Background(), 2)
+	equal(t, "pending", string(value))
+	equal(t, nil, store.Close())
+	info, _ := os.Stat(path)
+	equal(t, int64(0), info.Size())
+}
+
+// Stores whose writes are durable drop the records of the writes applied
+// from the WAL as they go, once it grows past its limit
+func TestWALCheckpoint(t *testing.T) {
+	stores := map[string]func(dir string, options ...Option) (Store, error){
+		"file": func(dir string, options ...Option) (Store, error) {
+			return NewFile(dir, time.Second, options...)
+		},
+		"btree": func(dir string, options ...Option) (Store, error) {
+			return NewBTree(dir, time.Second, options...)
+		},
+	}
+	record := int64(len(encodeWAL(walSet, 1, []byte("value"))))
+	for name, open := range stores {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "hashes.wal")
+		wal, _ := OpenWAL(path, SyncPolicy{Mode: SYNC_ALWAYS})
+		wal.limit = 1
+		c := fake()
+		s, err := open(dir, WithClock(c), WithWAL(wal))
+		equal(t, nil, err)
+		s.Set(context.Background(), []byte("value"))
+		c.Advance(time.Second / 2)
+		s.Set(context.Background(), []byte("value"))
+		c.Advance(time.Second / 2)
+		s.Wait(context.Background(), 1)
+		info, _ := os.Stat(path)
+		if info.Size() != record {
+			t.Errorf("%s: expected the pending record only - got: %d bytes", name, info.Size())
+		}
+		equal(t, nil, s.Update(context.Background(), 1, []byte("updated")))
+		c.Advance(time.Second / 2)
+		s.Wait(context.Background(), 2)
+		info, _ = os.Stat(path)
+		if info.Size() != 0 {
+			t.Errorf("%s: expected an empty WAL - got: %d bytes", name, info.Size())
+		}
+		// Still working after the file is replaced
+		s.Set(context.Background(), []byte("value"))
+		info, _ = os.Stat(path)
+		equal(t, record, info.Size())
+		c.Advance(time.Second)
+		equal(t, nil, s.Close())
+	}
+}
+
+// A checkpoint failing to replace the WAL (here, to sync its directory
+// after the rename) is sticky, the next Set fails instead of going on
+func TestWALCheckpointFailure(t *testing.T) {
+	dir := t.TempDir()
+	wal, _ := OpenWAL(filepath.Join(dir, "hashes.wal"), SyncPolicy{Mode: SYNC_ALWAYS})
+	wal.limit = 1
+	wal.fsync = func(file *os.File) error {
+		if file.Name() == dir {
+			return errors.New("sync failed")
+		}
+		return file.Sync()
+	}
+	c := fake()
+	s, err := NewFile(dir, time.Second, WithClock(c), WithWAL(wal))
+	equal(t, nil, err)
+	id, err := s.Set(context.Background(), []byte("value"))
+	equal(t, nil, err)
+	c.Advance(time.Second)
+	s.Wait(context.Background(), id)
+	_, err = s.Set(context.Background(), []byte("value"))
+	equal(t, true, err != nil && strings.Contains(err.Error(), "sync failed"))
+	s.Close()
+}
+
+// The final checkpoint of a closed WAL is synced like Truncate, failures
+// are returned while late commits keep failing with ErrClosed
+func TestWALFinalCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hashes.wal")
+	wal, _ := OpenWAL(path, SyncPolicy{Mode: SYNC_ALWAYS})
+	equal(t, nil, wal.commit(wal.append(walSet, 1, []byte("value"))))
+	equal(t, nil, wal.Close())
+	synced := 0
+	wal.fsync = func(file *os.File) error {
+		synced++
+		return errors.New("sync failed")
+	}
+	err := wal.checkpoint(wal.last())
+	equal(t, true, err != nil && strings.Contains(err.Error(), "sync failed"))
+	equal(t, 1, synced)
+	equal(t, ErrClosed, wal.commit(wal.append(walSet, 2, []byte("late"))))
+	wal.fsync = (*os.File).Sync
+	equal(t, nil, wal.checkpoint(wal.last()))
+	info, _ := os.Stat(path)
+	equal(t, int64(0), info.Size())
+}
+
+// Updates are logged as their own records and replayed in order, on top
+// of the data the store already has
+func TestWALUpdate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hashes.wal")
+	policy := SyncPolicy{Mode: SYNC_ALWAYS}
+	wal, _ := OpenWAL(path, policy)
+	c := fake()
+	crashed, _ := NewFile(dir, 0, WithClock(c), WithWAL(wal))
+	crashed.Set(context.Background(), []byte("value"))
+	crashed.Wait(context.Background(), 1)
+	equal(t, nil, crashed.Update(context.Background(), 1, []byte("first")))
+	equal(t, nil, crashed.Update(context.Background(), 1, []byte("second")))
+
+	entries := func() []walEntry {
+		wal, _ := OpenWAL(path, policy)
+		defer wal.Close()
+		return wal.recovered()
+	}()
+	equal(t, 3, len(entries))
+	equal(t, byte(walSet), entries[0].kind)
+	equal(t, byte(walUpdate), entries[2].kind)
+	equal(t, "second", string(entries[2].value))
+
+	// Replayed on a store missing every record
+	wal, _ = OpenWAL(path, policy)
+	m := NewMemory(0, WithWAL(wal))
+	value, _ := m.Get(context.Background(), 1)
+	equal(t, "second", string(value))
+	m.Close()
+	crashed.Close()
+}
+
+// Records buffered by the time a commit starts are synced together
+func TestWALGroupCommit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hashes.wal")
+	wal, _ := OpenWAL(path, SyncPolicy{Mode: SYNC_ALWAYS})
+	for i := 1; i <= 3; i++ {
+		wal.append(walSet, i, []byte("value"))
+	}
+	equal(t, nil, wal.commit(3))
+	equal(t, nil, wal.commit(1))
+	equal(t, 1, wal.syncs)
+	// The next sync blocks until every write is waiting on its commit,
+	// so all of them are covered by the sync right after it
+	release := make(chan struct{})
+	fsync := wal.fsync
+	wal.fsync = func(file *os.File) error {
+		<-release
+		return fsync(file)
+	}
+	m := NewMemory(0, WithWAL(wal))
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := m.Set(context.Background(), []byte("value"))
+			equal(t, nil, err)
+		}()
+	}
+	for appended := uint64(0); appended < 103; {
+		runtime.Gosched()
+		wal.Lock()
+		appended = wal.appended
+		wal.Unlock()
+	}
+	close(release)
+	wg.Wait()
+	equal(t, true, wal.syncs <= 3)
+	equal(t, nil, m.Close())
+	equal(t, nil, wal.Close())
+	// Fails once closed
+	equal(t, ErrClosed, wal.commit(wal.append(walSet, 104, []byte("late"))))
+}
+
+// Writes that fail to be logged are never applied and free their slot
+func TestWALCommitFailure(t *testing.T) {
+	dir := t.TempDir()
+	wal, _ := OpenWAL(filepath.Join(dir, "hashes.wal"), SyncPolicy{Mode: SYNC_ALWAYS})
+	c := fake()
+	m := NewMemory(time.Second, WithClock(c), WithWAL(wal), WithBackpressure(2, 0))
+	id, err := m.Set(context.Background(), []byte("logged"))
+	equal(t, nil, err)
+	// Every write after the file fails is dropped right away
+	wal.file.Close()
+	for i := 0; i < 3; i++ {
+		_, err = m.Set(context.Background(), []byte("dropped"))
+		equal(t, true, err != nil && !errors.Is(err, ErrBackpressure))
+		equal(t, 1, m.Pending())
+	}
+	_, err = m.Get(context.Background(), 2)
+	equal(t, ErrNotFound, err)
+	c.Advance(time.Second)
+	m.Wait(context.Background(), id)
+	value, _ := m.Get(context.Background(), id)
+	equal(t, "logged", string(value))
+	m.Close()
+
+	// The head of the queue is dropped by the routine draining it
+	wal, _ = OpenWAL(filepath.Join(dir, "head.wal"), SyncPolicy{Mode: SYNC_ALWAYS})
+	m = NewMemory(time.Second, WithClock(c), WithWAL(wal))
+	wal.file.Close()
+	_, err = m.Set(context.Background(), []byte("dropped"))
+	equal(t, true, err != nil)
+	equal(t, nil, m.Wait(context.Background(), 1))
+	equal(t, 0, m.Pending())
+	_, err = m.Get(context.Background(), 1)
+	equal(t, ErrNotFound, err)
+	m.Close()
+}
+
+// A torn record at the end (crash mid-write) is dropped
+func TestWALTorn(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hashes.wal")
+	wal, _ := OpenWAL(path, SyncPolicy{Mode: SYNC_NEVER})
+	wal.commit(wal.append(walSet, 1, []byte("value")))
+	wal.Close()
+	info, _ := os.Stat(path)
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	file.Write(encodeWAL(walSet, 2, []byte("torn"))[:walHeaderSize+2])
+	file.Close()
+
+	wal, err := OpenWAL(path, SyncPolicy{Mode: SYNC_NEVER})
+	equal(t, nil, err)
+	defer wal.Close()
+	equal(t, 1, len(wal.recovered()))
+	torn, _ := os.Stat(path)
+	equal(t, info.Size(), torn.Size())
+}